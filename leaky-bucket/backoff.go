@@ -0,0 +1,133 @@
+package leakyBucket
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gofaquan/leaky-bucket/internal/clock"
+)
+
+// BackoffLimiter 包装任意 Limiter 限制器，在连续多次 Take 被阻塞后，
+// 每次 Take 前额外等待一段逐渐增长（直到上限）的退避时间；
+// 当 Take 不再阻塞时，退避时间逐渐衰减回 0。
+// 它用来避免大量客户端同时重试，冲击一个已经饱和的下游服务。
+// 它只实现 Limiter，不转发被包装的限制器实现的 ContextTaker 等可选接口：
+// 退避的延迟用 Clock.Sleep 等待，不能被取消，所以它应当作为最外层的包装使用。
+type BackoffLimiter struct {
+	sync.Mutex
+	limiter Limiter // 被包装的限制器
+	clock   Clock   // 时钟
+
+	after       int           // 连续阻塞多少次后开始退避
+	blockedWait time.Duration // Take 等待超过这个时间才算被阻塞
+	initial     time.Duration // 第一次退避的额外延迟
+	max         time.Duration // 额外延迟的上限
+	multiplier  float64       // 持续阻塞时延迟增长的倍数
+	decay       float64       // 不再阻塞时延迟衰减的倍数
+
+	blocks int           // 当前连续阻塞的次数
+	delay  time.Duration // 当前的额外延迟
+}
+
+// BackoffOption 用 Option设计模式 配置一个 BackoffLimiter.
+type BackoffOption func(b *BackoffLimiter)
+
+// NewBackoffLimiter 返回一个包装了 l 的 BackoffLimiter。
+// 默认连续阻塞 3 次后开始退避，延迟从 10ms 开始翻倍增长，最多 1s，不阻塞时减半。
+func NewBackoffLimiter(l Limiter, opts ...BackoffOption) *BackoffLimiter {
+	b := &BackoffLimiter{
+		limiter:     l,
+		after:       3,
+		blockedWait: time.Millisecond,
+		initial:     10 * time.Millisecond,
+		max:         time.Second,
+		multiplier:  2,
+		decay:       0.5,
+	}
+	for _, opt := range opts {
+		opt(b)
+	}
+	if b.clock == nil {
+		b.clock = clock.New()
+	}
+	return b
+}
+
+// WithBackoffClock 返回一个 BackoffOption，用于替换时钟，通常是用于测试的模拟时钟。
+// 它应当与被包装的限制器使用同一个时钟。
+func WithBackoffClock(clock Clock) BackoffOption {
+	return func(b *BackoffLimiter) {
+		b.clock = clock
+	}
+}
+
+// WithBackoffAfter 返回一个 BackoffOption，
+// 设置连续 k 次 Take 等待超过 blockedWait 之后开始退避。
+func WithBackoffAfter(k int, blockedWait time.Duration) BackoffOption {
+	return func(b *BackoffLimiter) {
+		b.after = k
+		b.blockedWait = blockedWait
+	}
+}
+
+// WithBackoffDelay 返回一个 BackoffOption，设置第一次退避的延迟和延迟的上限。
+func WithBackoffDelay(initial, max time.Duration) BackoffOption {
+	return func(b *BackoffLimiter) {
+		b.initial = initial
+		b.max = max
+	}
+}
+
+// WithBackoffFactors 返回一个 BackoffOption，
+// 设置持续阻塞时延迟的增长倍数 multiplier (> 1) 和不再阻塞时的衰减倍数 decay (< 1)。
+func WithBackoffFactors(multiplier, decay float64) BackoffOption {
+	return func(b *BackoffLimiter) {
+		b.multiplier = multiplier
+		b.decay = decay
+	}
+}
+
+// Take 先等待当前的额外延迟，再调用被包装的限制器的 Take，
+// 并根据这次 Take 是否被阻塞来调整之后的延迟。
+func (b *BackoffLimiter) Take() time.Time {
+	b.Lock()
+	delay := b.delay
+	b.Unlock()
+	if delay > 0 {
+		b.clock.Sleep(delay)
+	}
+
+	start := b.clock.Now()
+	t := b.limiter.Take()
+	blocked := since(b.clock, start) > b.blockedWait
+
+	b.Lock()
+	defer b.Unlock()
+	if blocked {
+		b.blocks++
+		if b.blocks >= b.after {
+			b.delay = time.Duration(float64(b.delay) * b.multiplier)
+			if b.delay < b.initial {
+				b.delay = b.initial
+			}
+			if b.delay > b.max {
+				b.delay = b.max
+			}
+		}
+	} else {
+		b.blocks = 0
+		// 衰减到第一次退避的延迟以下时直接归零
+		b.delay = time.Duration(float64(b.delay) * b.decay)
+		if b.delay < b.initial {
+			b.delay = 0
+		}
+	}
+	return t
+}
+
+// Delay 返回当前每次 Take 前的额外延迟。
+func (b *BackoffLimiter) Delay() time.Duration {
+	b.Lock()
+	defer b.Unlock()
+	return b.delay
+}
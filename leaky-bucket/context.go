@@ -0,0 +1,63 @@
+package leakyBucket
+
+import (
+	"context"
+	"time"
+)
+
+// TakeContext 与 Take 相同，但在 ctx 被取消时不再等待，立即返回 ctx.Err()。
+// 与 Take 一样，它在锁内预约好放行的时刻，释放锁之后再等待，
+// 等待通过时钟的定时器完成 (见 sleepContext)，不需要为每次调用启动一个 goroutine。
+// 被取消时预约的间隔会归还给限制器，之后的请求可以提前一个间隔放行。
+func (t *limiter) TakeContext(ctx context.Context) (time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return time.Time{}, err
+	}
+	t.Lock()
+	now := t.clock.Now()
+	interval := t.interval(now)
+	last, wait := t.reserve(now)
+	clock := t.clock
+	t.Unlock()
+
+	if wait > 0 {
+		if err := sleepContext(ctx, clock, wait); err != nil {
+			// 归还这次预约的间隔：sleepFor 减去一个间隔，下一个请求计算 sleepFor 时会抵消它。
+			// 这里不按 maxSlack 限制，否则 WithoutSlack 的限制器无法归还，限制由下一次 reserve 完成
+			t.Lock()
+			t.sleepFor -= interval
+			t.Unlock()
+			return time.Time{}, err
+		}
+	}
+	t.observe(1, wait, true)
+	return last, nil
+}
+
+// afterClock 是提供了定时器的时钟，sleepContext 用它等待而不必启动 goroutine。
+type afterClock interface {
+	After(d time.Duration) <-chan time.Time
+}
+
+// sleepContext 在时钟 c 上等待 d，ctx 被取消时提前返回 ctx.Err()。
+// c 提供了 After 方法 (如内部的实时时钟和模拟时钟) 时用它的定时器等待；
+// 否则只能在另一个 goroutine 中调用 Sleep，ctx 被取消后这个 goroutine 仍会睡到 d 结束。
+func sleepContext(ctx context.Context, c Clock, d time.Duration) error {
+	var done <-chan time.Time
+	if a, ok := c.(afterClock); ok {
+		done = a.After(d)
+	} else {
+		ch := make(chan time.Time, 1)
+		go func() {
+			c.Sleep(d)
+			ch <- c.Now()
+		}()
+		done = ch
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,34 @@
+package leakyBucket
+
+import "sync"
+
+// Gate 把阻塞的 Limiter 转换成通道：每当 l 放行一个请求，就向返回的通道发送一个值，
+// 于是可以在事件循环中与其他通道一起 select。
+// 内部有一个 goroutine 循环调用 l.Take() 并发送到通道，发送在接收方就绪时才完成。
+// 调用返回的 close 函数停止这个 goroutine，goroutine 退出时关闭通道；
+// 如果 goroutine 正阻塞在 Take 中，要等这次 Take 返回后才退出。close 可以调用多次。
+func Gate(l Limiter) (<-chan struct{}, func()) {
+	ch := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(ch)
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			l.Take()
+			select {
+			case ch <- struct{}{}:
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() { close(done) })
+	}
+}
@@ -10,8 +10,10 @@ import (
 //当测试基于时间的功能时，它可以比实时时钟更好。
 type Mock struct {
 	sync.Mutex
-	now    time.Time // current time
-	timers Timers    // timers
+	advance sync.Mutex // 串行化 Add 的调用，触发定时器时 Mutex 会被释放
+	now     time.Time  // current time
+	timers  Timers     // timers
+	seq     uint64     // 下一个定时器的序号
 }
 
 // NewMock 返回一个模拟时钟的实例。
@@ -21,25 +23,52 @@ func NewMock() *Mock {
 }
 
 // Add 将模拟时钟的当前时间向前移动 d 。
-//每次只能从一个 goroutine 调用。
+// 可以从多个 goroutine 并发调用，这些调用依次执行，时钟一共向前移动它们的 d 之和。
 func (m *Mock) Add(d time.Duration) {
+	// 触发定时器时会释放 m.Mutex，需要另一把锁保证同一时刻只有一个 Add 在处理定时器堆
+	m.advance.Lock()
+	defer m.advance.Unlock()
+
 	m.Lock()
 	// Calculate the final time.
 	end := m.now.Add(d)
 
-	for len(m.timers) > 0 && m.now.Before(end) {
+	// 按顺序触发所有在 end 之前 (含 end) 到期的定时器，
+	// 同一时刻到期的定时器逐个触发，不会在第一个之后就停下。
+	for len(m.timers) > 0 && !m.timers[0].next.After(end) {
 		t := heap.Pop(&m.timers).(*Timer)
 		m.now = t.next
 		m.Unlock()
 		t.Tick()
 		m.Lock()
 	}
+	m.now = end
 
 	m.Unlock()
 	//给一个小的缓冲区，以确保其他 goroutines 得到处理。
 	nap() //nap 午睡，休息
 }
 
+// AdvanceBy 以固定的步长 step 把模拟时钟向前推进共 d 的时间，最后一步不足 step 时只推进剩余的部分。
+// Add 会在一次调用中触发所有到期的定时器，可能掩盖先后顺序上的问题；
+// 分步推进使每个定时器在它自然的边界附近触发，便于逐步模拟。
+// step <= 0 时等同于 m.Add(d)。
+// 与其他 goroutine 并发调用 Add 时，每一步都是独立的 Add，其他调用可能插入在两步之间。
+func AdvanceBy(m *Mock, d time.Duration, step time.Duration) {
+	if step <= 0 {
+		m.Add(d)
+		return
+	}
+	for d > 0 {
+		s := step
+		if s > d {
+			s = d
+		}
+		m.Add(s)
+		d -= s
+	}
+}
+
 // Timer produces a timer that will emit a time some duration after now.
 // Timer 生成一个 Timer，它将在 一段时间(d) 后发出一个时间。
 func (m *Mock) Timer(d time.Duration) *Timer {
@@ -48,15 +77,18 @@ func (m *Mock) Timer(d time.Duration) *Timer {
 		C:    ch,
 		c:    ch,
 		mock: m,
-		next: m.now.Add(d),
 	}
-	m.addTimer(t)
+	m.addTimer(t, d)
 	return t
 }
 
-func (m *Mock) addTimer(t *Timer) {
+// addTimer 设置定时器在 d 之后触发并加入堆中，同时为它分配递增的序号。
+func (m *Mock) addTimer(t *Timer, d time.Duration) {
 	m.Lock()
 	defer m.Unlock()
+	t.next = m.now.Add(d)
+	t.seq = m.seq
+	m.seq++
 	heap.Push(&m.timers, t)
 }
 
@@ -85,6 +117,11 @@ func (m *Mock) Now() time.Time {
 	return m.now
 }
 
+// Since 返回从 t 到模拟时钟的当前时间经过的时间。
+func (m *Mock) Since(t time.Time) time.Duration {
+	return m.Now().Sub(t)
+}
+
 // Sleep 在模拟时钟上暂停 给定时间(d) 的 goroutine。
 //时钟必须向前移动在一个单独的 goroutine。
 func (m *Mock) Sleep(d time.Duration) {
@@ -96,6 +133,7 @@ type Timer struct {
 	C    <-chan time.Time
 	c    chan time.Time
 	next time.Time // next tick time
+	seq  uint64    // 创建的序号，触发时间相同时序号小的先触发
 	mock *Mock     // mock clock
 }
 
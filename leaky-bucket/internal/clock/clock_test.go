@@ -0,0 +1,125 @@
+package clock
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestSimultaneousTimersFireInOrder(t *testing.T) {
+	m := NewMock()
+	var (
+		mu    sync.Mutex
+		fired []int
+	)
+	for i := 0; i < 8; i++ {
+		i := i
+		m.AfterFunc(time.Second, func() {
+			mu.Lock()
+			fired = append(fired, i)
+			mu.Unlock()
+		})
+	}
+	m.Add(time.Second)
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(fired) != 8 {
+		t.Fatalf("fired %d timers, want 8", len(fired))
+	}
+	for i, n := range fired {
+		if n != i {
+			t.Fatalf("fire order = %v, want creation order", fired)
+		}
+	}
+}
+
+func TestConcurrentAdd(t *testing.T) {
+	m := NewMock()
+	var (
+		mu    sync.Mutex
+		fired int
+	)
+	for i := 1; i <= 10; i++ {
+		m.AfterFunc(time.Duration(i)*time.Second, func() {
+			mu.Lock()
+			fired++
+			mu.Unlock()
+		})
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			m.Add(time.Second)
+		}()
+	}
+	wg.Wait()
+
+	if got, want := m.Now(), time.Unix(0, 0).Add(10*time.Second); !got.Equal(want) {
+		t.Fatalf("Now() = %v, want %v", got, want)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if fired != 10 {
+		t.Fatalf("fired %d timers, want 10", fired)
+	}
+}
+
+func TestMockSince(t *testing.T) {
+	m := NewMock()
+	start := m.Now()
+	m.Add(3 * time.Second)
+	if got := m.Since(start); got != 3*time.Second {
+		t.Fatalf("Since() = %v, want 3s", got)
+	}
+}
+
+func TestAdvanceBy(t *testing.T) {
+	m := NewMock()
+	var (
+		mu    sync.Mutex
+		fired []time.Duration
+	)
+	// 故意不按到期的先后创建定时器
+	for _, d := range []time.Duration{950, 250, 1000, 500, 750} {
+		d := d * time.Millisecond
+		m.AfterFunc(d, func() {
+			mu.Lock()
+			fired = append(fired, m.Now().Sub(time.Unix(0, 0)))
+			mu.Unlock()
+		})
+	}
+	check := func(want ...time.Duration) {
+		t.Helper()
+		mu.Lock()
+		defer mu.Unlock()
+		if len(fired) != len(want) {
+			t.Fatalf("fired at %v, want %v", fired, want)
+		}
+		for i := range want {
+			if fired[i] != want[i]*time.Millisecond {
+				t.Fatalf("fired at %v, want %v ms", fired, want)
+			}
+		}
+	}
+
+	// 最后一步只推进剩余的 100ms，750ms 的定时器还没有到期
+	AdvanceBy(m, 700*time.Millisecond, 300*time.Millisecond)
+	if got, want := m.Now(), time.Unix(0, 0).Add(700*time.Millisecond); !got.Equal(want) {
+		t.Fatalf("Now() = %v, want %v", got, want)
+	}
+	check(250, 500)
+
+	// 每个定时器在它到期的时刻按顺序触发
+	AdvanceBy(m, 300*time.Millisecond, 100*time.Millisecond)
+	check(250, 500, 750, 950, 1000)
+
+	// step <= 0 时与 Add 相同
+	AdvanceBy(m, time.Second, 0)
+	if got, want := m.Now(), time.Unix(0, 0).Add(2*time.Second); !got.Equal(want) {
+		t.Fatalf("Now() = %v, want %v", got, want)
+	}
+}
@@ -9,5 +9,6 @@ import "time"
 type Clock interface {
 	AfterFunc(d time.Duration, f func())
 	Now() time.Time
+	Since(t time.Time) time.Duration
 	Sleep(d time.Duration)
 }
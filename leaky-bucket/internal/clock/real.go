@@ -23,5 +23,8 @@ func (c *clock) AfterFunc(d time.Duration, f func()) {
 // Now 返回现在的时间
 func (c *clock) Now() time.Time { return time.Now() }
 
+// Since 返回从 t 到现在经过的时间
+func (c *clock) Since(t time.Time) time.Duration { return time.Since(t) }
+
 // Sleep 睡眠 d 的时间
 func (c *clock) Sleep(d time.Duration) { time.Sleep(d) }
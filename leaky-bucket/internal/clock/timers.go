@@ -11,9 +11,13 @@ func (ts Timers) Swap(i, j int) {
 	ts[i], ts[j] = ts[j], ts[i]
 }
 
-// Less 把 ts[i] ~ ts[j] 从双向链表中去除
+// Less 比较两个计时器的先后：先比较触发时间，触发时间相同时先创建的排在前面，
+// 保证同一时刻的计时器按创建顺序 (FIFO) 触发。
 func (ts Timers) Less(i, j int) bool {
-	return ts[i].Next().Before(ts[j].Next())
+	if !ts[i].Next().Equal(ts[j].Next()) {
+		return ts[i].Next().Before(ts[j].Next())
+	}
+	return ts[i].seq < ts[j].seq
 }
 
 // Push 加入一个元素到最列表中，类似 元素的入栈
@@ -0,0 +1,137 @@
+package leakyBucket
+
+import (
+	"context"
+	"math"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/gofaquan/leaky-bucket/internal/clock"
+)
+
+// latencyReservoirSize 是 LatencyTracker 最多保存的等待时间样本数。
+const latencyReservoirSize = 1024
+
+// LatencyTracker 包装任意 Limiter 限制器，记录每次 Take 等待的时间，
+// 通过 Quantile 读取 P50、P99 等分位数，用于跟踪 SLO，不需要外部的直方图。
+// 样本用蓄水池抽样保存，无论调用多少次，内存占用都不超过 latencyReservoirSize 个样本，
+// 所以调用次数远多于样本数时分位数是近似值。
+// 它实现了 ContextTaker、TryTaker 和 Namer，被包装的限制器不支持时按 TakeContext、TryTake 和 NameOf 的方式处理；
+// 其他可选的接口 (如 BatchAllower、Inspector) 不转发，需要时请直接使用被包装的限制器。
+type LatencyTracker struct {
+	Limiter
+	clock Clock
+
+	mu      sync.Mutex
+	samples []time.Duration
+	seen    int64      // 记录过的等待次数，包括没有保存在蓄水池中的
+	rnd     *rand.Rand // 决定新样本是否替换蓄水池中的旧样本
+}
+
+// LatencyOption 用 Option设计模式 配置一个 LatencyTracker.
+type LatencyOption func(lt *LatencyTracker)
+
+// WithLatencyClock 返回一个 LatencyOption，用于替换计时的时钟，通常是用于测试的模拟时钟。
+// 它应当与被包装的限制器使用同一个时钟。
+func WithLatencyClock(clock Clock) LatencyOption {
+	return func(lt *LatencyTracker) {
+		lt.clock = clock
+	}
+}
+
+// WithLatencyRand 返回一个 LatencyOption，设置蓄水池抽样使用的随机数，
+// 通常用于在测试中得到确定的样本。r 只在锁内使用，但不能同时交给其他代码使用。
+func WithLatencyRand(r *rand.Rand) LatencyOption {
+	return func(lt *LatencyTracker) {
+		lt.rnd = r
+	}
+}
+
+// LatencyTracked 返回一个包装了 l、记录等待时间的 LatencyTracker。
+// 没有使用 WithLatencyRand 时，每个 LatencyTracker 用各自的种子抽样，不同实例保留的样本互不相关。
+func LatencyTracked(l Limiter, opts ...LatencyOption) *LatencyTracker {
+	lt := &LatencyTracker{
+		Limiter: l,
+	}
+	for _, opt := range opts {
+		opt(lt)
+	}
+	if lt.rnd == nil {
+		lt.rnd = rand.New(rand.NewSource(time.Now().UnixNano()))
+	}
+	if lt.clock == nil {
+		lt.clock = clock.New()
+	}
+	return lt
+}
+
+// Take 调用被包装的限制器的 Take，并记录它等待的时间。
+func (lt *LatencyTracker) Take() time.Time {
+	start := lt.clock.Now()
+	t := lt.Limiter.Take()
+	lt.record(since(lt.clock, start))
+	return t
+}
+
+// TakeContext 以 TakeContext(ctx, l) 的方式调用被包装的限制器，成功时记录它等待的时间。
+func (lt *LatencyTracker) TakeContext(ctx context.Context) (time.Time, error) {
+	start := lt.clock.Now()
+	t, err := TakeContext(ctx, lt.Limiter)
+	if err == nil {
+		lt.record(since(lt.clock, start))
+	}
+	return t, err
+}
+
+// TryTake 以 TryTake(l) 的方式调用被包装的限制器，放行时记录它等待的时间。
+func (lt *LatencyTracker) TryTake() (time.Time, bool) {
+	start := lt.clock.Now()
+	t, ok := TryTake(lt.Limiter)
+	if ok {
+		lt.record(since(lt.clock, start))
+	}
+	return t, ok
+}
+
+// Name 返回被包装的限制器的名字，见 NameOf。
+func (lt *LatencyTracker) Name() string {
+	return NameOf(lt.Limiter)
+}
+
+// Quantile 返回记录的等待时间的 q 分位数，q 在 [0, 1] 内，超出时按边界处理，
+// 例如 Quantile(0.5) 是中位数，Quantile(0.99) 是 P99。还没有记录时返回 0。
+func (lt *LatencyTracker) Quantile(q float64) time.Duration {
+	lt.mu.Lock()
+	sorted := append([]time.Duration(nil), lt.samples...)
+	lt.mu.Unlock()
+	if len(sorted) == 0 {
+		return 0
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	// 最近秩法：不小于 q 比例的样本都不大于结果
+	i := int(math.Ceil(q*float64(len(sorted)))) - 1
+	if i < 0 || math.IsNaN(q) {
+		i = 0
+	}
+	if i >= len(sorted) {
+		i = len(sorted) - 1
+	}
+	return sorted[i]
+}
+
+// record 把一次等待的时间放入蓄水池。
+func (lt *LatencyTracker) record(d time.Duration) {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	lt.seen++
+	if len(lt.samples) < latencyReservoirSize {
+		lt.samples = append(lt.samples, d)
+		return
+	}
+	// 第 seen 个样本以 size/seen 的概率替换一个随机的旧样本，每个样本被保留的概率相同
+	if j := lt.rnd.Int63n(lt.seen); j < latencyReservoirSize {
+		lt.samples[j] = d
+	}
+}
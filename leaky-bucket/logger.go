@@ -0,0 +1,42 @@
+package leakyBucket
+
+import "time"
+
+// 传给 Logger 的日志级别。
+const (
+	LevelDebug = "debug"
+	LevelWarn  = "warn"
+)
+
+// Logger 接收限制器的结构化日志，适合没有指标系统、只想记录日志的场景。
+// 它与 token-bucket 包中的 Logger 类型相同，level 为 LevelDebug 或 LevelWarn，
+// fields 中包含 name (见 WithName)、count 等字段。Logger 总是在释放锁之后调用。
+type Logger func(level, msg string, fields map[string]interface{})
+
+// WithLogger 返回一个 ratelimit.New 的 Option，为限制器设置 Logger：
+// 请求被拒绝或需要等待时输出 debug 级别的日志。不设置时没有任何开销。
+func WithLogger(l Logger) Option {
+	return func(lim *limiter) {
+		lim.logger = l
+	}
+}
+
+// logTake 把一次请求的结果输出到 Logger，调用者不能持有锁。
+func (t *limiter) logTake(n int64, wait time.Duration, ok bool) {
+	if t.logger == nil {
+		return
+	}
+	switch {
+	case !ok:
+		t.logger(LevelDebug, "rate limiter throttled", map[string]interface{}{
+			"name":  t.name,
+			"count": n,
+		})
+	case wait > 0:
+		t.logger(LevelDebug, "rate limiter waiting", map[string]interface{}{
+			"name":  t.name,
+			"count": n,
+			"wait":  wait,
+		})
+	}
+}
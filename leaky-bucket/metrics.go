@@ -0,0 +1,53 @@
+package leakyBucket
+
+import "time"
+
+// Metrics 接收限制器的放行、拒绝和等待事件，用于对接 Prometheus 等指标系统。
+// 它与 token-bucket 包中的 Metrics 接口方法完全相同，同一个适配器可以同时用于两种限制器。
+// 回调总是在释放锁之后调用，不会占用限流的临界区。
+type Metrics interface {
+	// Allowed 在 n 个请求被放行时调用
+	Allowed(n int64)
+	// Throttled 在 n 个请求被拒绝时调用
+	Throttled(n int64)
+	// WaitObserved 报告请求被放行之前等待的时间，无需等待时为 0
+	WaitObserved(d time.Duration)
+}
+
+// WithMetrics 返回一个 ratelimit.New 的 Option，为限制器设置 Metrics。
+func WithMetrics(m Metrics) Option {
+	return func(l *limiter) {
+		l.metrics = m
+	}
+}
+
+// WithPanicHandler 返回一个 ratelimit.New 的 Option，设置 Metrics 和 Logger 回调 panic 时的处理函数。
+// 回调中的 panic 总是被 recover，不会使调用 Take 的 goroutine 崩溃，放行的结果也不受影响，
+// 只是这一次事件余下的回调不再被调用；设置了 h 时以 recover 的值调用它，便于记录有问题的回调。
+func WithPanicHandler(h func(v interface{})) Option {
+	return func(l *limiter) {
+		l.onPanic = h
+	}
+}
+
+// recoverCallback 在 observe 中被 defer，recover 回调的 panic 并交给 onPanic。
+func (t *limiter) recoverCallback() {
+	if v := recover(); v != nil && t.onPanic != nil {
+		t.onPanic(v)
+	}
+}
+
+// observe 把一次请求的结果报告给 Metrics 和 Logger，调用者不能持有锁。
+func (t *limiter) observe(n int64, wait time.Duration, ok bool) {
+	defer t.recoverCallback()
+	t.logTake(n, wait, ok)
+	if t.metrics == nil {
+		return
+	}
+	if !ok {
+		t.metrics.Throttled(n)
+		return
+	}
+	t.metrics.Allowed(n)
+	t.metrics.WaitObserved(wait)
+}
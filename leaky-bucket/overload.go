@@ -0,0 +1,136 @@
+package leakyBucket
+
+import (
+	"sync"
+	"time"
+
+	"github.com/gofaquan/leaky-bucket/internal/clock"
+)
+
+// minOverloadSamples 是判断持续过载所需的最少等待样本数，避免单次偶然的长等待触发拒绝。
+const minOverloadSamples = 3
+
+// OverloadGuard 包装任意阻塞的 Limiter 限制器，用于过载时主动丢弃请求。
+// 它记录最近一个时间窗口内每次 Take 的等待时间，当窗口内的平均等待超过阈值时，
+// 认为下游处于持续过载，在接下来的冷却期内所有请求立即被拒绝，不再排队等待。
+// 时间窗口和冷却期都由 Clock 度量，可以使用模拟时钟测试。
+// 因为 Take 可能拒绝请求，它返回 (time.Time, bool)，不实现 Limiter，
+// 而是与 New 返回的限制器一样实现 TryTaker，拒绝时返回 false。
+type OverloadGuard struct {
+	sync.Mutex
+	limiter Limiter // 被包装的限制器
+	clock   Clock   // 时钟
+
+	threshold time.Duration // 平均等待超过它即认为过载
+	window    time.Duration // 统计等待时间的窗口
+	cooldown  time.Duration // 过载后快速拒绝的时长
+
+	samples     []waitSample // 窗口内的等待样本，按时间排序
+	rejectUntil time.Time    // 在这个时刻之前快速拒绝
+}
+
+// waitSample 是一次 Take 结束的时刻和它等待的时间。
+type waitSample struct {
+	at   time.Time
+	wait time.Duration
+}
+
+// GuardOption 用 Option设计模式 配置一个 OverloadGuard.
+type GuardOption func(g *OverloadGuard)
+
+// NewOverloadGuard 返回一个包装了 l 的 OverloadGuard。
+// 默认在最近 1s 内的平均等待超过 100ms 时拒绝接下来 1s 内的请求。
+func NewOverloadGuard(l Limiter, opts ...GuardOption) *OverloadGuard {
+	g := &OverloadGuard{
+		limiter:   l,
+		threshold: 100 * time.Millisecond,
+		window:    time.Second,
+		cooldown:  time.Second,
+	}
+	for _, opt := range opts {
+		opt(g)
+	}
+	if g.clock == nil {
+		g.clock = clock.New()
+	}
+	return g
+}
+
+// WithGuardClock 返回一个 GuardOption，用于替换时钟，通常是用于测试的模拟时钟。
+// 它应当与被包装的限制器使用同一个时钟。
+func WithGuardClock(clock Clock) GuardOption {
+	return func(g *OverloadGuard) {
+		g.clock = clock
+	}
+}
+
+// WithGuardThreshold 返回一个 GuardOption，设置在 window 时间内平均等待超过 threshold 时认为过载。
+func WithGuardThreshold(threshold, window time.Duration) GuardOption {
+	return func(g *OverloadGuard) {
+		g.threshold = threshold
+		g.window = window
+	}
+}
+
+// WithGuardCooldown 返回一个 GuardOption，设置过载后快速拒绝请求的时长。
+func WithGuardCooldown(d time.Duration) GuardOption {
+	return func(g *OverloadGuard) {
+		g.cooldown = d
+	}
+}
+
+// Take 在冷却期内立即返回 false；否则调用被包装的限制器的 Take，记录等待时间，
+// 返回放行的时刻和 true。
+func (g *OverloadGuard) Take() (time.Time, bool) {
+	start := g.clock.Now()
+	g.Lock()
+	rejecting := start.Before(g.rejectUntil)
+	g.Unlock()
+	if rejecting {
+		return time.Time{}, false
+	}
+
+	t := g.limiter.Take()
+	now := g.clock.Now()
+
+	g.Lock()
+	defer g.Unlock()
+	g.samples = append(g.samples, waitSample{at: now, wait: now.Sub(start)})
+	g.expire(now)
+	if len(g.samples) >= minOverloadSamples && g.meanWait() > g.threshold {
+		g.rejectUntil = now.Add(g.cooldown)
+		g.samples = g.samples[:0]
+	}
+	return t, true
+}
+
+// TryTake 与 Take 相同，使 OverloadGuard 可以用在接受 TryTaker 的地方。
+func (g *OverloadGuard) TryTake() (time.Time, bool) {
+	return g.Take()
+}
+
+// Overloaded 报告当前是否处于快速拒绝的冷却期。
+func (g *OverloadGuard) Overloaded() bool {
+	now := g.clock.Now()
+	g.Lock()
+	defer g.Unlock()
+	return now.Before(g.rejectUntil)
+}
+
+// expire 丢弃窗口之外的样本。
+func (g *OverloadGuard) expire(now time.Time) {
+	i := 0
+	for i < len(g.samples) && now.Sub(g.samples[i].at) > g.window {
+		i++
+	}
+	g.samples = g.samples[:copy(g.samples, g.samples[i:])]
+}
+
+// meanWait 返回窗口内样本的平均等待时间。
+func (g *OverloadGuard) meanWait() time.Duration {
+	var total time.Duration
+	for _, s := range g.samples {
+		total += s.wait
+	}
+	return total / time.Duration(len(g.samples))
+}
@@ -0,0 +1,106 @@
+package leakyBucket
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"github.com/gofaquan/leaky-bucket/internal/clock"
+)
+
+// ErrClosed 在 PacedLimiter 被 Close 之后由 TakeContext 返回。
+var ErrClosed = errors.New("leaky bucket paced limiter is closed")
+
+// PacedLimiter 是由时钟驱动的平滑限制器：一个 goroutine 每隔 1/rate 秒向通道中放出一个名额，
+// Take 从通道中接收名额。与 New 返回的限制器在每次调用时计算 sleep 的时间不同，
+// 有请求在等待时名额严格按 start + k*interval 的网格放出，间隔不受调用者的时机影响，也不会累积误差；
+// 没有请求在等待时不会积攒名额，网格从下一个到达的请求重新开始，
+// 因此任意两次放行之间至少相隔一个间隔，不存在 slack 带来的突发。
+// 使用完毕后必须调用 Close，否则放出名额的 goroutine 会一直存在。
+type PacedLimiter struct {
+	permits  chan struct{}
+	clock    Clock
+	name     string
+	interval time.Duration
+
+	ctx    context.Context // Close 时取消，用于停止 goroutine 和唤醒等待中的请求
+	cancel context.CancelFunc
+}
+
+// NewPaced 返回一个每秒放行 rate 个请求的 PacedLimiter。rate 必须为正，否则 panic。
+// opts 中只有 WithClock 和 WithName 起作用，其他 Option 没有意义，会被忽略。
+func NewPaced(rate int, opts ...Option) *PacedLimiter {
+	if rate <= 0 {
+		panic(ErrInvalidRate.Error())
+	}
+	cfg := &limiter{}
+	for _, opt := range opts {
+		opt(cfg)
+	}
+	if cfg.clock == nil {
+		cfg.clock = clock.New()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p := &PacedLimiter{
+		permits:  make(chan struct{}),
+		clock:    cfg.clock,
+		name:     cfg.name,
+		interval: time.Second / time.Duration(rate),
+		ctx:      ctx,
+		cancel:   cancel,
+	}
+	go p.run()
+	return p
+}
+
+// run 按网格放出名额，直到 Close 被调用。
+func (p *PacedLimiter) run() {
+	next := p.clock.Now()
+	for {
+		if d := next.Sub(p.clock.Now()); d > 0 {
+			if err := sleepContext(p.ctx, p.clock, d); err != nil {
+				return
+			}
+		}
+		select {
+		case p.permits <- struct{}{}:
+		default:
+			// 没有请求在等待，名额不积攒，网格从下一个请求到达的时刻重新开始
+			select {
+			case p.permits <- struct{}{}:
+				next = p.clock.Now()
+			case <-p.ctx.Done():
+				return
+			}
+		}
+		next = next.Add(p.interval)
+	}
+}
+
+// Take 等待下一个名额，返回放行的时刻。Close 之后不再等待，立即返回零值。
+func (p *PacedLimiter) Take() time.Time {
+	at, _ := p.TakeContext(context.Background())
+	return at
+}
+
+// TakeContext 与 Take 相同，但在 ctx 被取消时返回 ctx.Err()，Close 之后返回 ErrClosed。
+func (p *PacedLimiter) TakeContext(ctx context.Context) (time.Time, error) {
+	select {
+	case <-p.permits:
+		return p.clock.Now(), nil
+	case <-ctx.Done():
+		return time.Time{}, ctx.Err()
+	case <-p.ctx.Done():
+		return time.Time{}, ErrClosed
+	}
+}
+
+// Name 返回用 WithName 设置的名字。
+func (p *PacedLimiter) Name() string {
+	return p.name
+}
+
+// Close 停止放出名额的 goroutine，并唤醒所有等待中的请求。重复调用没有影响。
+func (p *PacedLimiter) Close() {
+	p.cancel()
+}
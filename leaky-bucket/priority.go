@@ -0,0 +1,142 @@
+package leakyBucket
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// PriorityLimiter 是带有优先级抢占的平滑限制器，用于混合的工作负载：
+// 优先级达到 preempt 的请求不受间隔限制，立即放行，但仍然记入一个间隔，相当于借用了之后的额度；
+// 优先级更低的请求按间隔放行，同时等待的请求中优先级高的先放行，优先级相同的按到达顺序放行。
+//
+// 每次抢占都把之后的放行时刻向后推一个间隔 (即 sleepFor 增加 perRequest)，
+// 所以抢占之后到达或仍在排队的低优先级请求要多等一个间隔，总的速率仍然不超过 rate。
+// 已经排到、正在等待放行时刻的低优先级请求不受之后的抢占影响。
+// 抢占的请求本身不受限制，持续的高优先级流量会使低优先级的请求一直等待。
+type PriorityLimiter struct {
+	limiter *limiter
+	preempt int
+
+	mu          sync.Mutex
+	waiting     priorityQueue
+	seq         uint64
+	dispatching bool // 为 true 时有一个 goroutine 正在按优先级放行等待的请求
+}
+
+// NewPriority 返回一个每秒放行 rate 个请求、优先级不低于 preempt 的请求可以抢占的 PriorityLimiter。
+// opts 与 New 相同，rate 必须为正，否则 panic。
+func NewPriority(rate int, preempt int, opts ...Option) *PriorityLimiter {
+	l, err := NewErr(rate, opts...)
+	if err != nil {
+		panic(err.Error())
+	}
+	return &PriorityLimiter{limiter: l.(*limiter), preempt: preempt}
+}
+
+// Take 以优先级 prio 请求放行，返回放行的时刻。
+// prio >= preempt 时立即返回，否则阻塞到按间隔轮到它为止。
+func (p *PriorityLimiter) Take(prio int) time.Time {
+	l := p.limiter
+	if prio >= p.preempt {
+		l.Lock()
+		now := l.clock.Now()
+		l.reserve(now)
+		l.Unlock()
+		l.observe(1, 0, true)
+		return now
+	}
+
+	p.mu.Lock()
+	if !p.dispatching {
+		// 没有人排队时，无需等待就直接放行
+		l.Lock()
+		now := l.clock.Now()
+		if l.chargeN(now, 1) <= 0 {
+			last, _ := l.reserve(now)
+			l.Unlock()
+			p.mu.Unlock()
+			l.observe(1, 0, true)
+			return last
+		}
+		l.Unlock()
+	}
+	w := &priorityWaiter{
+		prio:  prio,
+		seq:   p.seq,
+		ready: make(chan struct{}),
+	}
+	p.seq++
+	heap.Push(&p.waiting, w)
+	if !p.dispatching {
+		p.dispatching = true
+		go p.dispatch()
+	}
+	p.mu.Unlock()
+
+	start := l.clock.Now()
+	<-w.ready
+	l.observe(1, since(l.clock, start), true)
+	return w.at
+}
+
+// dispatch 依次取出优先级最高的请求，等到它的放行时刻后放行，队列为空时退出。
+// 等待时不持有限制器的锁，所以抢占的请求不会被阻塞。
+func (p *PriorityLimiter) dispatch() {
+	l := p.limiter
+	for {
+		p.mu.Lock()
+		if p.waiting.Len() == 0 {
+			p.dispatching = false
+			p.mu.Unlock()
+			return
+		}
+		w := heap.Pop(&p.waiting).(*priorityWaiter)
+		p.mu.Unlock()
+
+		l.Lock()
+		at, wait := l.reserve(l.clock.Now())
+		l.Unlock()
+		if wait > 0 {
+			l.clock.Sleep(wait)
+		}
+		w.at = at
+		close(w.ready)
+	}
+}
+
+// Name 返回用 WithName 设置的名字。
+func (p *PriorityLimiter) Name() string {
+	return p.limiter.name
+}
+
+// priorityWaiter 是一个等待放行的低优先级请求。
+type priorityWaiter struct {
+	prio  int
+	seq   uint64
+	at    time.Time // 放行的时刻，在 ready 关闭前写入
+	ready chan struct{}
+}
+
+// priorityQueue 是按优先级从高到低、优先级相同时按 seq 排序的堆。
+type priorityQueue []*priorityWaiter
+
+func (q priorityQueue) Len() int { return len(q) }
+
+func (q priorityQueue) Less(i, j int) bool {
+	if q[i].prio != q[j].prio {
+		return q[i].prio > q[j].prio
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q priorityQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *priorityQueue) Push(x interface{}) { *q = append(*q, x.(*priorityWaiter)) }
+
+func (q *priorityQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return w
+}
@@ -0,0 +1,99 @@
+package leakyBucket
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/gofaquan/leaky-bucket/internal/clock"
+)
+
+// Queue 是真正意义上的 "作为队列的漏桶"。
+// 与 Limiter 的平滑限速不同，请求通过 Add 进入一个容量有限的桶，
+// 桶以固定的速率漏出，桶满时新的请求直接被拒绝，而不是阻塞等待。
+type Queue struct {
+	sync.Mutex
+	level    float64   // 桶中当前的水位（积压量）
+	capacity float64   // 桶的容量，即允许的最大积压量
+	leakRate float64   // 每秒漏出的量
+	last     time.Time // 上一次计算水位的时刻
+	clock    Clock     // 时钟
+}
+
+// QueueOption 用 Option设计模式 配置一个 Queue.
+type QueueOption func(q *Queue)
+
+// WithQueueClock 返回一个 NewQueue 的 QueueOption，用于替换时钟，通常是用于测试的模拟时钟。
+func WithQueueClock(clock Clock) QueueOption {
+	return func(q *Queue) {
+		q.clock = clock
+	}
+}
+
+// NewQueue 返回一个容量为 capacity、每秒漏出 rate 个请求的漏桶队列，参数均要为正。
+func NewQueue(capacity, rate int, opts ...QueueOption) *Queue {
+	if capacity <= 0 {
+		panic("leaky bucket queue capacity is not > 0")
+	}
+	if rate <= 0 {
+		panic("leaky bucket queue rate is not > 0")
+	}
+	q := &Queue{
+		capacity: float64(capacity),
+		leakRate: float64(rate),
+	}
+	for _, opt := range opts {
+		opt(q)
+	}
+	if q.clock == nil {
+		q.clock = clock.New()
+	}
+	q.last = q.clock.Now()
+	return q
+}
+
+// Add 尝试把一个请求放入桶中。
+// 桶中还有空间时请求入队并返回 true，否则返回 false 且不改变桶的状态。
+func (q *Queue) Add() bool {
+	q.Lock()
+	defer q.Unlock()
+
+	q.leak(q.clock.Now())
+	if q.level+1 > q.capacity {
+		return false
+	}
+	q.level++
+	return true
+}
+
+// AddN 尝试把 n 个请求放入桶中，放得下多少就放入多少，适合允许部分接受的批量写入。
+// 它先按经过的时间漏出水位，再计算剩余的空间，返回接受的个数和之后桶中剩余的空间 (都向下取整)。
+// n 不为正时不放入任何请求，只返回剩余的空间。
+func (q *Queue) AddN(n int) (accepted int, remaining int) {
+	q.Lock()
+	defer q.Unlock()
+
+	q.leak(q.clock.Now())
+	free := math.Floor(q.capacity - q.level)
+	if n > 0 {
+		accepted = n
+		if float64(n) > free {
+			accepted = int(free)
+		}
+		q.level += float64(accepted)
+		free -= float64(accepted)
+	}
+	return accepted, int(free)
+}
+
+// leak 按照从上一次计算到 now 经过的时间漏出水位，水位不会低于 0。
+// 时钟回拨时不做任何处理，等时间重新越过 last 再继续漏出。
+func (q *Queue) leak(now time.Time) {
+	if elapsed := now.Sub(q.last); elapsed > 0 {
+		q.level -= q.leakRate * elapsed.Seconds()
+		if q.level < 0 {
+			q.level = 0
+		}
+		q.last = now
+	}
+}
@@ -1,6 +1,8 @@
 package leakyBucket
 
 import (
+	"context"
+	"errors"
 	"github.com/gofaquan/leaky-bucket/internal/clock"
 	"sync"
 	"time"
@@ -17,6 +19,80 @@ type Limiter interface {
 	Take() time.Time
 }
 
+// 下面是 Limiter 可以选择实现的接口，New 和 NewUnlimited 返回的限制器实现了全部这些接口。
+// Limiter 本身只要求 Take，所以只实现了 Take 的已有实现仍然是 Limiter；
+// 需要这些功能时用类型断言检查，或使用 TakeContext、TryTake 和 NameOf 等在不支持时有退路的函数。
+
+// ContextTaker 是可以取消等待的限制器。
+type ContextTaker interface {
+	// TakeContext 与 Take 相同，但在 ctx 被取消时停止等待并返回 ctx.Err()
+	TakeContext(ctx context.Context) (time.Time, error)
+}
+
+// TryTaker 是可以拒绝等待太久的请求的限制器。
+type TryTaker interface {
+	// TryTake 与 Take 相同，但需要等待的时间超过 WithMaxFuture 设置的上限时不等待，立即返回 false
+	TryTake() (time.Time, bool)
+}
+
+// BatchAllower 是可以不阻塞地一次放行多个请求的限制器。
+type BatchAllower interface {
+	// AllowN 不阻塞，只有在无需等待时才放行 n 个请求并返回放行的时刻，否则返回 false
+	AllowN(n int) (time.Time, bool)
+}
+
+// Inspector 是可以在不占用名额的情况下查询放行时刻的限制器。
+type Inspector interface {
+	// RetryAfter 返回 count 个请求还需要等待多久才能放行，可以立即放行时返回 0
+	RetryAfter(count int64) time.Duration
+	// NextAt 返回下一次 Take 会被放行的时刻，不占用名额
+	NextAt() time.Time
+	// Plan 返回接下来依次调用 n 次 Take 会被放行的时刻，不阻塞也不占用名额
+	Plan(n int) []time.Time
+}
+
+// Namer 是有名字的限制器。
+type Namer interface {
+	// Name 返回限制器的名字，用于在日志和指标中区分多个限制器，没有设置时为空字符串
+	Name() string
+}
+
+// TakeContext 在 l 实现了 ContextTaker 时调用它的 TakeContext；
+// 否则在另一个 goroutine 中调用 Take，ctx 被取消时不再等待并返回 ctx.Err()，
+// 但那次 Take 仍会在之后完成并占用名额。
+func TakeContext(ctx context.Context, l Limiter) (time.Time, error) {
+	if c, ok := l.(ContextTaker); ok {
+		return c.TakeContext(ctx)
+	}
+	if err := ctx.Err(); err != nil {
+		return time.Time{}, err
+	}
+	done := make(chan time.Time, 1)
+	go func() { done <- l.Take() }()
+	select {
+	case at := <-done:
+		return at, nil
+	case <-ctx.Done():
+		return time.Time{}, ctx.Err()
+	}
+}
+
+// TryTake 在 l 实现了 TryTaker 时调用它的 TryTake，否则调用 Take 并返回 true。
+func TryTake(l Limiter) (time.Time, bool) {
+	if t, ok := l.(TryTaker); ok {
+		return t.TryTake()
+	}
+	return l.Take(), true
+}
+
+// NameOf 在 l 实现了 Namer 时返回它的名字，否则返回空字符串。
+func NameOf(l Limiter) string {
+	if n, ok := l.(Namer); ok {
+		return n.Name()
+	}
+	return ""
+}
+
 // Clock 时钟是实例化 一个速率限制器 所需的 最小接口
 //一个时钟或模拟时钟，兼容使用
 type Clock interface {
@@ -24,6 +100,15 @@ type Clock interface {
 	Sleep(time.Duration)
 }
 
+// since 返回在时钟 c 上从 t 到现在经过的时间。
+// c 提供了 Since 方法 (如内部的实时时钟和模拟时钟) 时使用它，否则用 Now 计算。
+func since(c Clock, t time.Time) time.Duration {
+	if s, ok := c.(interface{ Since(time.Time) time.Duration }); ok {
+		return s.Since(t)
+	}
+	return c.Now().Sub(t)
+}
+
 type limiter struct {
 	sync.Mutex               // 锁
 	last       time.Time     // 上一次的时刻
@@ -31,16 +116,44 @@ type limiter struct {
 	perRequest time.Duration // 每次的时间间隔
 	maxSlack   time.Duration // 最大的富余量
 	clock      Clock         // 时钟
+	metrics    Metrics       // 指标，可以为 nil
+	logger     Logger        // 日志，可以为 nil
+	name       string        // 名字，见 WithName
+	maxFuture  time.Duration // TryTake 最多预约到多久之后，见 WithMaxFuture
+
+	warmup      time.Duration // 预热的时长，为 0 时不预热
+	warmupStart time.Time     // 预热开始的时刻，即创建限制器的时刻
+
+	onPanic func(v interface{}) // 回调 panic 时的处理函数，见 WithPanicHandler，可以为 nil
+	phase   time.Duration       // 第一次放行相对创建时刻的偏移，见 WithPhaseOffset
 }
 
 // Option 用 Option设计模式 配置一个 Limiter 限制器.
 type Option func(l *limiter)
 
+// ErrInvalidRate 在传入的 rate 不为正数时由 NewErr 返回。
+var ErrInvalidRate = errors.New("leaky bucket rate is not > 0")
+
 // New 返回一个限制器，将限制给定的 RPS  (revolutions per second) 。
+// rate 必须为正，否则 panic，需要自行处理错误的配置请使用 NewErr。
 func New(rate int, opts ...Option) Limiter {
+	l, err := NewErr(rate, opts...)
+	if err != nil {
+		panic(err.Error())
+	}
+	return l
+}
+
+// NewErr 与 New 相同，但 rate <= 0 时返回 ErrInvalidRate 而不是 panic，
+// 便于从配置创建限制器时给出明确的错误。
+func NewErr(rate int, opts ...Option) (Limiter, error) {
+	if rate <= 0 {
+		return nil, ErrInvalidRate
+	}
 	l := &limiter{
 		perRequest: time.Second / time.Duration(rate),       //每次的时间间隔 = 1 / rate 秒, eg: 1/3 = 333.333333 ms
 		maxSlack:   -10 * time.Second / time.Duration(rate), // 最大的富余量 = -10 * rate 秒
+		maxFuture:  maxDuration,
 	}
 	//为上方的 limiter 配置 各种参数，如下方的 WithClock ，传入即可配置对应 clock 参数
 	for _, opt := range opts {
@@ -50,7 +163,12 @@ func New(rate int, opts ...Option) Limiter {
 	if l.clock == nil {
 		l.clock = clock.New()
 	}
-	return l
+	l.warmupStart = l.clock.Now()
+	if l.phase > 0 {
+		// 假装上一个请求在 phase - perRequest 时放行，第一个请求就排在 phase 之后
+		l.last = l.warmupStart.Add(l.phase - l.perRequest)
+	}
+	return l, nil
 }
 
 // WithClock 返回一个 ratelimit.New 的 Option。
@@ -61,6 +179,19 @@ func WithClock(clock Clock) Option {
 	}
 }
 
+// WithName 返回一个 ratelimit.New 的 Option，为限制器设置名字，通过 Name 读取。
+// 存在多个限制器时，可以用名字标记日志和指标。
+func WithName(name string) Option {
+	return func(l *limiter) {
+		l.name = name
+	}
+}
+
+// Name 返回用 WithName 设置的名字。
+func (t *limiter) Name() string {
+	return t.name
+}
+
 // WithoutSlack 是 ratelimit.New 的一个初始化 Option。
 // 初始化一个 没有任何初始容忍突发流量的 limiter 限制器。
 var WithoutSlack Option = withoutSlackOption
@@ -69,6 +200,107 @@ func withoutSlackOption(l *limiter) {
 	l.maxSlack = 0
 }
 
+// maxDuration 是 time.Duration 的最大值，表示没有上限。
+const maxDuration time.Duration = 1<<63 - 1
+
+// WithMaxFuture 返回一个 ratelimit.New 的 Option，限制 TryTake 最多把请求安排到 d 之后放行：
+// 放行的时刻 (即返回的 last) 会晚于当前时刻 d 以上时，TryTake 不预约也不等待，立即返回 false，
+// 避免大量调用者都被安排到几分钟之后。d 为 0 时 TryTake 只在无需等待时放行。
+// 它不影响 Take 和 TakeContext：Take 总是等待到轮到它为止，不会被拒绝；
+// AllowN 本来就只在无需等待时放行。不设置时 TryTake 与 Take 相同。
+func WithMaxFuture(d time.Duration) Option {
+	return func(l *limiter) {
+		l.maxFuture = d
+	}
+}
+
+// coldFactor 是预热开始时请求间隔相对 perRequest 的倍数。
+const coldFactor = 3
+
+// WithWarmup 返回一个 ratelimit.New 的 Option，令限制器在创建后的 d 时间内逐渐预热：
+// 请求间隔从 3 倍的 perRequest 开始，按时钟经过的时间线性地减小到 perRequest，
+// 即速率从目标的 1/3 逐渐升到目标，避免进程刚启动时冲击还没有预热的下游。
+// 预热结束后与普通的限制器完全相同。
+func WithWarmup(d time.Duration) Option {
+	return func(l *limiter) {
+		l.warmup = d
+	}
+}
+
+// WithSlackRequests 返回一个 ratelimit.New 的 Option，
+// 以请求个数为单位设置最大的富余量：限制器最多容忍 n 个请求的突发追赶，
+// 即 maxSlack = -n * perRequest。默认相当于 WithSlackRequests(10)，
+// WithSlackRequests(0) 与 WithoutSlack 相同。
+// 富余量在应用 Option 时按 rate 换算，所以它只对 New 和 NewErr 有意义。
+func WithSlackRequests(n int) Option {
+	return func(l *limiter) {
+		l.maxSlack = -time.Duration(n) * l.perRequest
+	}
+}
+
+// WithPhaseOffset 返回一个 ratelimit.New 的 Option，把第一次放行推迟 id/total 个 perRequest，
+// 用于多个实例以相同的速率访问同一个下游的情况：以实例编号为 id、实例总数为 total，
+// 各个实例的放行时刻确定地错开，均匀地分布在一个间隔内，而不是随机的抖动或同时放行。
+// 之后的请求仍然按 perRequest 的间隔放行，所以相位一直保持错开，除非实例空闲后用富余量追赶。
+// total 必须为正，id 必须在 [0, total) 之内，否则 panic。
+func WithPhaseOffset(id int, total int) Option {
+	if total <= 0 {
+		panic("leaky bucket phase offset total is not > 0")
+	}
+	if id < 0 || id >= total {
+		panic("leaky bucket phase offset id is not in [0, total)")
+	}
+	return func(l *limiter) {
+		l.phase = time.Duration(int64(l.perRequest) * int64(id) / int64(total))
+	}
+}
+
+// SlackSetter 由 New 返回的限制器实现，用于在运行期间调整富余量：
+//
+//	l.(leakyBucket.SlackSetter).SetSlack(500 * time.Millisecond)
+type SlackSetter interface {
+	// SetSlack 把最大的富余量修改为 d，即最多容忍 d 时间的突发追赶
+	SetSlack(d time.Duration)
+}
+
+// SetSlack 在锁内把最大的富余量修改为 d (maxSlack = -d)，d 为负时按 0 处理，与 WithoutSlack 相同。
+// 当前已经攒下的富余量超过新的上限时立即被截断，所以收紧富余量马上就会减小允许的突发。
+func (t *limiter) SetSlack(d time.Duration) {
+	if d < 0 {
+		d = 0
+	}
+	t.Lock()
+	defer t.Unlock()
+	t.maxSlack = -d
+	if t.sleepFor < t.maxSlack {
+		t.sleepFor = t.maxSlack
+	}
+}
+
+// ClockSetter 由 New 返回的限制器实现，用于在运行期间替换时钟，例如在集成测试中换成模拟时钟：
+//
+//	l.(leakyBucket.ClockSetter).SetClock(mock)
+type ClockSetter interface {
+	// SetClock 把限制器的时钟替换为 clock，保留当前的间隔状态
+	SetClock(clock Clock)
+}
+
+// SetClock 在锁内把时钟替换为 clock。上一次放行的时刻 last 和预热的起点被平移到新的时钟上
+// 与现在相距同样远的地方，sleepFor 不变，所以下一个请求仍要在新的时钟上等待同样长的时间，
+// 攒下的富余量和预热的进度也都保留，就像时钟没有被替换过一样。
+// 调用时不应有其他 goroutine 正在 Take 中等待，它们可能仍在旧的时钟上睡眠。
+func (t *limiter) SetClock(clock Clock) {
+	t.Lock()
+	defer t.Unlock()
+	old := t.clock.Now()
+	now := clock.Now()
+	if !t.last.IsZero() {
+		t.last = now.Add(-old.Sub(t.last))
+	}
+	t.warmupStart = now.Add(-old.Sub(t.warmupStart))
+	t.clock = clock
+}
+
 //下面的代码根据记录每次请求的间隔时间和上一次请求的时刻来计算当次请求需要阻塞的时间 sleepFor ，
 //这里需要留意的是 sleepFor 的值可能为负，在经过间隔时间长的两次访问之后会导致随后大量的请求被放行，
 //所以代码中针对这个场景有专门的优化处理。创建限制器的 New() 函数中会为 maxSlack 设置初始值，
@@ -77,36 +309,188 @@ func withoutSlackOption(l *limiter) {
 // Take 会阻塞确保两次请求之间的时间走完
 // Take 调用平均数为 time.Second/rate.
 func (t *limiter) Take() time.Time {
-	t.Lock()
-	defer t.Unlock()
+	last, wait, _ := t.take(maxDuration)
+	t.observe(1, wait, true)
+	return last
+}
+
+// TryTake 与 Take 相同，但需要等待的时间超过 WithMaxFuture 设置的上限时，
+// 不改变限制器的状态，立即返回 false。
+func (t *limiter) TryTake() (time.Time, bool) {
+	last, wait, ok := t.take(t.maxFuture)
+	t.observe(1, wait, ok)
+	return last, ok
+}
 
+// take 是 Take 的内部版本，额外返回这次请求 sleep 的时间。
+// 需要 sleep 的时间超过 maxWait 时不改变状态，返回 false。
+// 放行的时刻在锁内预约，sleep 在释放锁之后进行，
+// 所以等待中的请求不会挡住其他请求 (例如 TakeContext 在取消时能立即返回)。
+func (t *limiter) take(maxWait time.Duration) (time.Time, time.Duration, bool) {
+	t.Lock()
 	now := t.clock.Now()
+	if maxWait != maxDuration && t.chargeN(now, 1) > maxWait {
+		t.Unlock()
+		return time.Time{}, 0, false
+	}
+	last, wait := t.reserve(now)
+	clock := t.clock
+	t.Unlock()
 
+	// 如果 sleepFor 是正值那么就 sleep
+	if wait > 0 {
+		clock.Sleep(wait)
+	}
+	return last, wait, true
+}
+
+// reserve 为在 now 时刻到达的一个请求计算放行的时刻和需要 sleep 的时间，并更新限制器的状态，
+// 但不 sleep。调用者需要持有锁。
+func (t *limiter) reserve(now time.Time) (time.Time, time.Duration) {
+	return t.reserveInterval(now, t.interval(now), t.maxSlack)
+}
+
+// reserveInterval 与 reserve 相同，但这个请求的间隔为 interval，sleepFor 最多负到 maxSlack。
+// 调用者需要持有锁。
+func (t *limiter) reserveInterval(now time.Time, interval, maxSlack time.Duration) (time.Time, time.Duration) {
 	// 如果是第一次请求就直接放行
 	if t.last.IsZero() {
 		t.last = now
-		return t.last
+		return t.last, 0
 	}
 
 	// sleepFor 根据 perRequest 和上一次请求的时刻计算应该 sleep 的时间
 	// 由于每次请求间隔的时间可能会超过 perRequest, 所以这个数字可能为负数，并在多个请求之间累加
-	t.sleepFor += t.perRequest - now.Sub(t.last)
+	t.sleepFor += interval - now.Sub(t.last)
 
 	// 我们不应该让 sleepFor 负的太多，因为这意味着一个服务在短时间内慢了很多随后会得到更高的 RPS。
-	if t.sleepFor < t.maxSlack {
-		t.sleepFor = t.maxSlack
+	if t.sleepFor < maxSlack {
+		t.sleepFor = maxSlack
 	}
 
-	// 如果 sleepFor 是正值那么就 sleep
+	// 如果 sleepFor 是正值，请求要在 sleepFor 之后才能放行
+	var wait time.Duration
 	if t.sleepFor > 0 {
-		t.clock.Sleep(t.sleepFor)
+		wait = t.sleepFor
 		t.last = now.Add(t.sleepFor)
 		t.sleepFor = 0
 	} else {
 		t.last = now
 	}
 
-	return t.last
+	return t.last, wait
+}
+
+// AllowN 是 Take 的非阻塞、可批量的版本。
+// 只有一次性记入 n 个请求的间隔后仍然不需要 sleep (sleepFor <= 0) 时才放行，
+// 返回放行的时刻和 true；否则返回 false，且不改变限制器的任何状态。
+func (t *limiter) AllowN(n int) (time.Time, bool) {
+	last, ok := t.allowN(n)
+	t.observe(int64(n), 0, ok)
+	return last, ok
+}
+
+// allowN 是 AllowN 的内部版本，不报告指标。
+func (t *limiter) allowN(n int) (time.Time, bool) {
+	t.Lock()
+	defer t.Unlock()
+
+	now := t.clock.Now()
+	if n <= 0 {
+		return now, true
+	}
+
+	sleepFor := t.chargeN(now, int64(n))
+	if sleepFor > 0 {
+		return time.Time{}, false
+	}
+
+	t.sleepFor = sleepFor
+	t.last = now
+	return t.last, true
+}
+
+// RetryAfter 返回现在一次放行 count 个请求需要 sleep 的时间，与 AllowN 的判断方式相同，
+// 可以立即放行时返回 0。它不改变限制器的状态，适合用来设置 HTTP 的 Retry-After 头。
+func (t *limiter) RetryAfter(count int64) time.Duration {
+	t.Lock()
+	defer t.Unlock()
+	if count <= 0 {
+		return 0
+	}
+	if sleepFor := t.chargeN(t.clock.Now(), count); sleepFor > 0 {
+		return sleepFor
+	}
+	return 0
+}
+
+// NextAt 返回现在调用 Take 会被放行的时刻，可以立即放行时返回当前时刻。
+// 它按 last + perRequest (并受 maxSlack 限制) 计算，不改变限制器的状态，
+// 适合在生产者循环中安排两次 Take 之间的其他工作。
+func (t *limiter) NextAt() time.Time {
+	t.Lock()
+	defer t.Unlock()
+	now := t.clock.Now()
+	if sleepFor := t.chargeN(now, 1); sleepFor > 0 {
+		return now.Add(sleepFor)
+	}
+	return now
+}
+
+// Plan 返回现在开始依次调用 n 次 Take 时每次被放行的时刻，可以交给调度器预先安排定时的工作。
+// 它在锁内从当前的 last 和 sleepFor 出发，按与 Take 相同的规则 (包括 maxSlack 和预热) 向前模拟：
+// 第一个请求在现在到达，之后的每个请求在前一个请求放行时到达。
+// 模拟结束后恢复原来的状态，所以它不阻塞，也不占用名额。n 不为正时返回 nil。
+func (t *limiter) Plan(n int) []time.Time {
+	if n <= 0 {
+		return nil
+	}
+	t.Lock()
+	defer t.Unlock()
+	last, sleepFor := t.last, t.sleepFor
+	defer func() { t.last, t.sleepFor = last, sleepFor }()
+
+	at := t.clock.Now()
+	plan := make([]time.Time, n)
+	for i := range plan {
+		plan[i], _ = t.reserve(at)
+		if plan[i].After(at) {
+			at = plan[i]
+		}
+	}
+	return plan
+}
+
+// chargeN 返回在 now 时刻一次记入 n 个请求的间隔之后的 sleepFor (已按 maxSlack 限制)，
+// 但不修改限制器的状态。还没有放行过任何请求时按已经空闲了很久处理，返回 maxSlack，
+// 与长时间空闲之后的结果相同，所以新的限制器上的 AllowN(n) 总是放行。调用者需要持有锁。
+func (t *limiter) chargeN(now time.Time, n int64) time.Duration {
+	if t.last.IsZero() {
+		// 还没有放行过请求，相当于已经空闲了无限长的时间，富余量是满的
+		return t.maxSlack
+	}
+	sleepFor := t.sleepFor + time.Duration(n)*t.interval(now) - now.Sub(t.last)
+	if sleepFor < t.maxSlack {
+		sleepFor = t.maxSlack
+	}
+	return sleepFor
+}
+
+// interval 返回 now 时刻每个请求之间的时间间隔，预热期间 (见 WithWarmup) 大于 perRequest。
+func (t *limiter) interval(now time.Time) time.Duration {
+	if t.warmup <= 0 {
+		return t.perRequest
+	}
+	elapsed := now.Sub(t.warmupStart)
+	if elapsed >= t.warmup {
+		return t.perRequest
+	}
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	// 间隔从 coldFactor * perRequest 线性地减小到 perRequest
+	cold := float64(t.perRequest) * coldFactor
+	return time.Duration(cold - (cold-float64(t.perRequest))*float64(elapsed)/float64(t.warmup))
 }
 
 type unlimited struct{}
@@ -120,3 +504,49 @@ func NewUnlimited() Limiter {
 func (unlimited) Take() time.Time {
 	return time.Now()
 }
+
+// TryTake 总是立即放行
+func (unlimited) TryTake() (time.Time, bool) {
+	return time.Now(), true
+}
+
+// TakeContext 在 ctx 没有被取消时总是立即放行
+func (unlimited) TakeContext(ctx context.Context) (time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return time.Time{}, err
+	}
+	return time.Now(), nil
+}
+
+// AllowN 总是放行
+func (unlimited) AllowN(n int) (time.Time, bool) {
+	return time.Now(), true
+}
+
+// RetryAfter 总是返回 0
+func (unlimited) RetryAfter(count int64) time.Duration {
+	return 0
+}
+
+// NextAt 总是返回当前时刻
+func (unlimited) NextAt() time.Time {
+	return time.Now()
+}
+
+// Plan 返回 n 个当前时刻
+func (unlimited) Plan(n int) []time.Time {
+	if n <= 0 {
+		return nil
+	}
+	plan := make([]time.Time, n)
+	now := time.Now()
+	for i := range plan {
+		plan[i] = now
+	}
+	return plan
+}
+
+// Name 返回空字符串
+func (unlimited) Name() string {
+	return ""
+}
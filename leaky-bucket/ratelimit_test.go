@@ -0,0 +1,868 @@
+package leakyBucket
+
+import (
+	"context"
+	"math/rand"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gofaquan/leaky-bucket/internal/clock"
+)
+
+// fakeClock 是一个只能手动调整的时钟，Sleep 直接把时间向前推进。
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(0, 0)}
+}
+
+func TestWarmup(t *testing.T) {
+	clock := newFakeClock()
+	rl := New(10, WithClock(clock), WithWarmup(time.Second), WithoutSlack)
+
+	prev := rl.Take()
+	var gaps []time.Duration
+	for i := 0; i < 20; i++ {
+		now := rl.Take()
+		gaps = append(gaps, now.Sub(prev))
+		prev = now
+	}
+
+	if gaps[0] != 300*time.Millisecond {
+		t.Fatalf("first gap = %v, want 300ms", gaps[0])
+	}
+	for i := 1; i < len(gaps); i++ {
+		if gaps[i] > gaps[i-1] {
+			t.Fatalf("gap %d = %v, larger than previous %v", i, gaps[i], gaps[i-1])
+		}
+	}
+	if last := gaps[len(gaps)-1]; last != 100*time.Millisecond {
+		t.Fatalf("last gap = %v, want 100ms", last)
+	}
+}
+
+func TestGate(t *testing.T) {
+	clock := newFakeClock()
+	ch, stop := Gate(New(10, WithClock(clock)))
+	for i := 0; i < 3; i++ {
+		<-ch
+	}
+	stop()
+	stop()
+	for range ch {
+	}
+}
+
+func TestTakeContext(t *testing.T) {
+	mock := clock.NewMock()
+	rl := New(10, WithClock(mock), WithoutSlack)
+	rl.Take()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() {
+		_, err := rl.(ContextTaker).TakeContext(ctx)
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if err := <-errc; err != context.Canceled {
+		t.Fatalf("TakeContext() error = %v, want context.Canceled", err)
+	}
+
+	// 被取消的请求归还了它的间隔，下一个请求占用它的位置
+	done := make(chan time.Time)
+	go func() {
+		last, err := rl.(ContextTaker).TakeContext(context.Background())
+		if err != nil {
+			t.Error(err)
+		}
+		done <- last
+	}()
+	time.Sleep(10 * time.Millisecond)
+	mock.Add(100 * time.Millisecond)
+	if got, want := <-done, time.Unix(0, 0).Add(100*time.Millisecond); !got.Equal(want) {
+		t.Fatalf("TakeContext() = %v, want %v", got, want)
+	}
+
+	if _, err := rl.(ContextTaker).TakeContext(ctx); err != context.Canceled {
+		t.Fatalf("TakeContext() with cancelled context error = %v", err)
+	}
+}
+
+func TestTakeContextWhileTakeSleeps(t *testing.T) {
+	mock := clock.NewMock()
+	rl := New(10, WithClock(mock), WithoutSlack)
+	rl.Take()
+
+	// 一个请求在 Take 中 sleep，等待 100ms 时放行
+	taken := make(chan time.Time)
+	go func() { taken <- rl.Take() }()
+	time.Sleep(10 * time.Millisecond)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() {
+		_, err := rl.(ContextTaker).TakeContext(ctx)
+		errc <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	select {
+	case err := <-errc:
+		if err != context.Canceled {
+			t.Fatalf("TakeContext() error = %v, want context.Canceled", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("TakeContext() was not cancelled while Take was sleeping")
+	}
+
+	// 被取消的请求在 200ms 预约的位置归还给了下一个请求
+	done := make(chan time.Time)
+	go func() { done <- rl.Take() }()
+	time.Sleep(10 * time.Millisecond)
+	mock.Add(200 * time.Millisecond)
+	if got, want := <-taken, time.Unix(0, 0).Add(100*time.Millisecond); !got.Equal(want) {
+		t.Fatalf("sleeping Take() = %v, want %v", got, want)
+	}
+	if got, want := <-done, time.Unix(0, 0).Add(200*time.Millisecond); !got.Equal(want) {
+		t.Fatalf("Take() after cancel = %v, want %v", got, want)
+	}
+}
+
+func TestTryTake(t *testing.T) {
+	clock := newFakeClock()
+	rl := New(10, WithClock(clock), WithoutSlack, WithMaxFuture(50*time.Millisecond))
+	rl.Take()
+
+	if _, ok := rl.(TryTaker).TryTake(); ok {
+		t.Fatal("TryTake() = true, want false when the wait exceeds the horizon")
+	}
+	if got := clock.Now(); !got.Equal(time.Unix(0, 0)) {
+		t.Fatalf("rejected TryTake moved the clock to %v", got)
+	}
+
+	clock.Sleep(60 * time.Millisecond)
+	last, ok := rl.(TryTaker).TryTake()
+	if !ok {
+		t.Fatal("TryTake() = false, want true within the horizon")
+	}
+	if want := time.Unix(0, 0).Add(100 * time.Millisecond); !last.Equal(want) {
+		t.Fatalf("TryTake() = %v, want %v", last, want)
+	}
+
+	// Take 不受上限影响
+	if got, want := rl.Take(), time.Unix(0, 0).Add(200*time.Millisecond); !got.Equal(want) {
+		t.Fatalf("Take() = %v, want %v", got, want)
+	}
+}
+
+func TestNextAt(t *testing.T) {
+	clock := newFakeClock()
+	rl := New(10, WithClock(clock), WithoutSlack)
+	if got := rl.(Inspector).NextAt(); !got.Equal(time.Unix(0, 0)) {
+		t.Fatalf("NextAt() before the first Take = %v", got)
+	}
+	rl.Take()
+	want := time.Unix(0, 0).Add(100 * time.Millisecond)
+	if got := rl.(Inspector).NextAt(); !got.Equal(want) {
+		t.Fatalf("NextAt() = %v, want %v", got, want)
+	}
+	// NextAt 不占用名额
+	if got := rl.Take(); !got.Equal(want) {
+		t.Fatalf("Take() = %v, want %v", got, want)
+	}
+}
+
+func TestLatencyTracked(t *testing.T) {
+	clock := newFakeClock()
+	lt := LatencyTracked(New(10, WithClock(clock), WithoutSlack), WithLatencyClock(clock))
+	if got := lt.Quantile(0.5); got != 0 {
+		t.Fatalf("Quantile(0.5) with no samples = %v, want 0", got)
+	}
+	for i := 0; i < 100; i++ {
+		lt.Take()
+	}
+	// 第一次不需要等待，之后每次等待 100ms
+	for q, want := range map[float64]time.Duration{0: 0, 0.01: 0, 0.02: 100 * time.Millisecond, 0.5: 100 * time.Millisecond, 0.99: 100 * time.Millisecond, 2: 100 * time.Millisecond} {
+		if got := lt.Quantile(q); got != want {
+			t.Errorf("Quantile(%v) = %v, want %v", q, got, want)
+		}
+	}
+
+	for i := 0; i < 3*latencyReservoirSize; i++ {
+		lt.Take()
+	}
+	if n := len(lt.samples); n != latencyReservoirSize {
+		t.Fatalf("kept %d samples, want %d", n, latencyReservoirSize)
+	}
+}
+
+// constSource 是总是返回同一个值的 rand.Source。
+type constSource int64
+
+func (s constSource) Int63() int64 { return int64(s) }
+func (constSource) Seed(int64)     {}
+
+func TestLatencyRand(t *testing.T) {
+	// 蓄水池满了之后，由注入的随机数决定新样本替换哪一个旧样本，或者被丢弃
+	for _, tt := range []struct {
+		src      constSource
+		replaced bool
+	}{
+		{0, true},
+		{latencyReservoirSize, false},
+	} {
+		lt := LatencyTracked(New(10), WithLatencyRand(rand.New(tt.src)))
+		for i := 0; i < latencyReservoirSize; i++ {
+			lt.record(time.Millisecond)
+		}
+		lt.record(time.Second)
+		if got := lt.samples[0] == time.Second; got != tt.replaced {
+			t.Errorf("source %d: replaced sample 0 = %v, want %v", tt.src, got, tt.replaced)
+		}
+		if got, want := lt.Quantile(1) == time.Second, tt.replaced; got != want {
+			t.Errorf("source %d: Quantile(1) = %v", tt.src, lt.Quantile(1))
+		}
+	}
+}
+
+func TestPanickingLogger(t *testing.T) {
+	clock := newFakeClock()
+	var recovered []interface{}
+	rl := New(10, WithClock(clock), WithoutSlack,
+		WithLogger(func(string, string, map[string]interface{}) { panic("logger") }),
+		WithPanicHandler(func(v interface{}) { recovered = append(recovered, v) }))
+	rl.Take()
+	if got, want := rl.Take(), time.Unix(0, 0).Add(100*time.Millisecond); !got.Equal(want) {
+		t.Fatalf("Take() = %v, want %v", got, want)
+	}
+	if len(recovered) != 1 || recovered[0] != "logger" {
+		t.Fatalf("recovered %v, want [logger]", recovered)
+	}
+}
+
+func TestPlan(t *testing.T) {
+	clock := newFakeClock()
+	rl := New(10, WithClock(clock))
+	if plan := rl.(Inspector).Plan(0); plan != nil {
+		t.Fatalf("Plan(0) = %v, want nil", plan)
+	}
+	rl.Take()
+	clock.Sleep(time.Second)
+
+	// 空闲 1s 攒下的富余量让前 10 个请求立即放行，之后每 100ms 一个
+	plan := rl.(Inspector).Plan(12)
+	for i, at := range plan {
+		want := time.Unix(1, 0)
+		if i >= 10 {
+			want = want.Add(time.Duration(i-9) * 100 * time.Millisecond)
+		}
+		if !at.Equal(want) {
+			t.Errorf("Plan(12)[%d] = %v, want %v", i, at, want)
+		}
+	}
+	// Plan 不改变状态，之后的 Take 与计划相同
+	for i, want := range plan {
+		if got := rl.Take(); !got.Equal(want) {
+			t.Errorf("Take() #%d = %v, want %v", i, got, want)
+		}
+	}
+}
+
+func TestSetSlack(t *testing.T) {
+	// burst 返回连续调用 Take 时不需要等待的次数
+	burst := func(rl Limiter, clock *fakeClock) int {
+		n := 0
+		for start := clock.Now(); rl.Take().Equal(start); n++ {
+		}
+		return n
+	}
+
+	clock := newFakeClock()
+	rl := New(10, WithClock(clock))
+	rl.Take()
+	clock.Sleep(time.Second)
+	if n := burst(rl, clock); n != 10 {
+		t.Fatalf("burst with the default slack = %d, want 10", n)
+	}
+
+	// 收紧富余量会截断已经攒下的富余量
+	clock.Sleep(time.Second)
+	rl.Take()
+	rl.(SlackSetter).SetSlack(200 * time.Millisecond)
+	if n := burst(rl, clock); n != 2 {
+		t.Fatalf("burst after SetSlack(200ms) = %d, want 2", n)
+	}
+
+	rl.(SlackSetter).SetSlack(-time.Second)
+	clock.Sleep(time.Second)
+	if n := burst(rl, clock); n != 1 {
+		t.Fatalf("burst after SetSlack(-1s) = %d, want 1", n)
+	}
+}
+
+func TestQueue(t *testing.T) {
+	clock := newFakeClock()
+	q := NewQueue(3, 2, WithQueueClock(clock))
+	for i := 0; i < 3; i++ {
+		if !q.Add() {
+			t.Fatalf("Add() #%d = false before the queue is full", i)
+		}
+	}
+	// 桶满时拒绝，被拒绝的请求不占用空间
+	for i := 0; i < 3; i++ {
+		if q.Add() {
+			t.Fatal("Add() = true on a full queue")
+		}
+	}
+
+	// 每秒漏出 2 个，半秒之后空出 1 个
+	clock.Sleep(500 * time.Millisecond)
+	if !q.Add() {
+		t.Fatal("Add() = false after leaking one")
+	}
+	if q.Add() {
+		t.Fatal("Add() = true, only one request leaked")
+	}
+
+	// 空闲很久之后水位降到 0，不会变为负数而接受超过容量的请求
+	clock.Sleep(time.Minute)
+	for i := 0; i < 3; i++ {
+		if !q.Add() {
+			t.Fatalf("Add() #%d = false after the queue drained", i)
+		}
+	}
+	if q.Add() {
+		t.Fatal("Add() = true beyond the capacity after draining")
+	}
+
+	for _, f := range []func(){
+		func() { NewQueue(0, 1) },
+		func() { NewQueue(1, 0) },
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Error("NewQueue with a non-positive argument did not panic")
+				}
+			}()
+			f()
+		}()
+	}
+}
+
+func TestQueueAddN(t *testing.T) {
+	clock := newFakeClock()
+	q := NewQueue(10, 4, WithQueueClock(clock))
+	check := func(n, wantAccepted, wantRemaining int) {
+		t.Helper()
+		if accepted, remaining := q.AddN(n); accepted != wantAccepted || remaining != wantRemaining {
+			t.Fatalf("AddN(%d) = %d, %d, want %d, %d", n, accepted, remaining, wantAccepted, wantRemaining)
+		}
+	}
+	check(6, 6, 4)
+	check(6, 4, 0)
+	check(1, 0, 0)
+
+	// 每秒漏出 4 个，半秒之后空出 2 个
+	clock.Sleep(500 * time.Millisecond)
+	check(0, 0, 2)
+	check(3, 2, 0)
+	clock.Sleep(250 * time.Millisecond)
+	if !q.Add() {
+		t.Fatal("Add() = false after leaking one")
+	}
+	check(-1, 0, 0)
+}
+
+// recordingSpan 记录设置的属性和是否结束。
+type recordingSpan struct {
+	name  string
+	attrs map[string]interface{}
+	ended bool
+}
+
+func (s *recordingSpan) SetAttribute(key string, value interface{}) { s.attrs[key] = value }
+
+func (s *recordingSpan) End() { s.ended = true }
+
+type recordingTracer struct {
+	spans []*recordingSpan
+}
+
+func (t *recordingTracer) Start(ctx context.Context, name string) (context.Context, Span) {
+	s := &recordingSpan{name: name, attrs: map[string]interface{}{}}
+	t.spans = append(t.spans, s)
+	return ctx, s
+}
+
+func TestTraced(t *testing.T) {
+	clock := newFakeClock()
+	tracer := &recordingTracer{}
+	rl := Traced(New(10, WithClock(clock), WithoutSlack, WithName("api")), WithTracer(tracer), WithTraceClock(clock))
+	rl.Take()
+	rl.Take()
+	if _, err := rl.TakeContext(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []map[string]interface{}{
+		{AttrLimiterName: "api", AttrWaitMillis: 0.0, AttrThrottled: false},
+		{AttrLimiterName: "api", AttrWaitMillis: 100.0, AttrThrottled: true},
+		{AttrLimiterName: "api", AttrWaitMillis: 100.0, AttrThrottled: true},
+	}
+	if len(tracer.spans) != len(want) {
+		t.Fatalf("got %d spans, want %d", len(tracer.spans), len(want))
+	}
+	for i, s := range tracer.spans {
+		if s.name != SpanName || !s.ended {
+			t.Errorf("span %d: name %q, ended %v", i, s.name, s.ended)
+		}
+		for k, v := range want[i] {
+			if s.attrs[k] != v {
+				t.Errorf("span %d: %s = %v, want %v", i, k, s.attrs[k], v)
+			}
+		}
+	}
+
+	// 没有 Tracer 时直接转发
+	plain := Traced(New(10, WithClock(clock)))
+	plain.Take()
+	if len(tracer.spans) != 3 {
+		t.Fatalf("untraced Take started a span")
+	}
+}
+
+func TestPaced(t *testing.T) {
+	mock := clock.NewMock()
+	p := NewPaced(10, WithClock(mock), WithName("paced"))
+	defer p.Close()
+	if p.Name() != "paced" {
+		t.Fatalf("Name() = %q", p.Name())
+	}
+
+	take := func() <-chan time.Time {
+		done := make(chan time.Time, 1)
+		go func() { done <- p.Take() }()
+		time.Sleep(10 * time.Millisecond)
+		return done
+	}
+	at := func(ms int) time.Time {
+		return time.Unix(0, 0).Add(time.Duration(ms) * time.Millisecond)
+	}
+
+	if got := <-take(); !got.Equal(at(0)) {
+		t.Fatalf("first Take() = %v, want %v", got, at(0))
+	}
+	// 有请求在等待时按网格放行
+	for _, ms := range []int{100, 200} {
+		done := take()
+		mock.Add(100 * time.Millisecond)
+		if got := <-done; !got.Equal(at(ms)) {
+			t.Fatalf("Take() = %v, want %v", got, at(ms))
+		}
+	}
+
+	// 空闲期间不积攒名额，网格从下一个请求重新开始
+	mock.Add(350 * time.Millisecond)
+	if got := <-take(); !got.Equal(at(550)) {
+		t.Fatalf("Take() after idle = %v, want %v", got, at(550))
+	}
+	done := take()
+	mock.Add(50 * time.Millisecond)
+	select {
+	case got := <-done:
+		t.Fatalf("Take() = %v before the interval passed", got)
+	default:
+	}
+	mock.Add(50 * time.Millisecond)
+	if got := <-done; !got.Equal(at(650)) {
+		t.Fatalf("Take() = %v, want %v", got, at(650))
+	}
+
+	// Close 唤醒等待中的请求
+	done = take()
+	p.Close()
+	if got := <-done; !got.IsZero() {
+		t.Fatalf("Take() after Close = %v, want zero", got)
+	}
+	if _, err := p.TakeContext(context.Background()); err != ErrClosed {
+		t.Fatalf("TakeContext() after Close error = %v, want ErrClosed", err)
+	}
+}
+
+func TestTakeWeighted(t *testing.T) {
+	clock := newFakeClock()
+	rl := New(10, WithClock(clock), WithoutSlack)
+	w := rl.(WeightedTaker)
+	start := clock.Now()
+	got := []time.Duration{
+		rl.Take().Sub(start),
+		w.TakeWeighted(2).Sub(start),
+		w.TakeWeighted(0.5).Sub(start),
+		rl.Take().Sub(start),
+		w.TakeWeighted(0).Sub(start),
+	}
+	want := []time.Duration{0, 200 * time.Millisecond, 250 * time.Millisecond, 350 * time.Millisecond, 350 * time.Millisecond}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("TakeWeighted() = %v, want %v", got, want)
+		}
+	}
+
+	// 富余量按权重缩放：空闲之后权重 0.5 的请求只保留 0.5s 的富余量，即 5 个请求
+	rl = New(10, WithClock(clock))
+	rl.Take()
+	clock.Sleep(5 * time.Second)
+	rl.(WeightedTaker).TakeWeighted(0.5)
+	before := clock.Now()
+	for i := 0; i < 5; i++ {
+		rl.Take()
+	}
+	if !clock.Now().Equal(before) {
+		t.Fatalf("slack was not kept for 5 requests")
+	}
+	rl.Take()
+	if d := clock.Now().Sub(before); d != 100*time.Millisecond {
+		t.Fatalf("sixth Take waited %v, want 100ms", d)
+	}
+}
+
+func TestPhaseOffset(t *testing.T) {
+	for id, offset := range []time.Duration{0, 33333333, 66666666} {
+		clock := newFakeClock()
+		start := clock.Now()
+		rl := New(10, WithClock(clock), WithPhaseOffset(id, 3))
+		if got := rl.Take().Sub(start); got != offset {
+			t.Errorf("instance %d: first Take() at %v, want %v", id, got, offset)
+		}
+		if got := rl.Take().Sub(start); got != offset+100*time.Millisecond {
+			t.Errorf("instance %d: second Take() at %v, want %v", id, got, offset+100*time.Millisecond)
+		}
+	}
+
+	for _, args := range [][2]int{{0, 0}, {-1, 3}, {3, 3}} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("WithPhaseOffset(%d, %d) did not panic", args[0], args[1])
+				}
+			}()
+			WithPhaseOffset(args[0], args[1])
+		}()
+	}
+}
+
+func TestSetClock(t *testing.T) {
+	old := &fakeClock{now: time.Unix(1e9, 0)}
+	rl := New(10, WithClock(old), WithoutSlack)
+	rl.Take()
+	rl.Take()
+	old.Sleep(30 * time.Millisecond)
+
+	mock := clock.NewMock()
+	rl.(ClockSetter).SetClock(mock)
+	// 上一次放行在 70ms 之前 (相对于新的时钟)，下一个请求还要等待 70ms
+	if got, want := rl.(Inspector).NextAt(), time.Unix(0, 0).Add(70*time.Millisecond); !got.Equal(want) {
+		t.Fatalf("NextAt() = %v, want %v", got, want)
+	}
+	done := make(chan time.Time)
+	go func() { done <- rl.Take() }()
+	time.Sleep(10 * time.Millisecond)
+	mock.Add(70 * time.Millisecond)
+	if got, want := <-done, time.Unix(0, 0).Add(70*time.Millisecond); !got.Equal(want) {
+		t.Fatalf("Take() = %v, want %v", got, want)
+	}
+}
+
+func TestPriority(t *testing.T) {
+	mock := clock.NewMock()
+	rl := NewPriority(10, 5, WithClock(mock), WithoutSlack)
+	at := func(ms int) time.Time {
+		return time.Unix(0, 0).Add(time.Duration(ms) * time.Millisecond)
+	}
+	take := func(prio int) <-chan time.Time {
+		done := make(chan time.Time, 1)
+		go func() { done <- rl.Take(prio) }()
+		time.Sleep(10 * time.Millisecond)
+		return done
+	}
+
+	if got := rl.Take(0); !got.Equal(at(0)) {
+		t.Fatalf("first Take() = %v, want %v", got, at(0))
+	}
+	a := take(1) // 排到 100ms
+	b := take(1)
+	c := take(3)
+	// 抢占立即放行，之后排队的请求都推迟一个间隔
+	if got := rl.Take(9); !got.Equal(at(0)) {
+		t.Fatalf("preempting Take() = %v, want %v", got, at(0))
+	}
+
+	mock.Add(100 * time.Millisecond)
+	if got := <-a; !got.Equal(at(100)) {
+		t.Fatalf("a = %v, want %v", got, at(100))
+	}
+	time.Sleep(10 * time.Millisecond)
+	mock.Add(200 * time.Millisecond)
+	if got := <-c; !got.Equal(at(300)) {
+		t.Fatalf("c = %v, want %v", got, at(300))
+	}
+	time.Sleep(10 * time.Millisecond)
+	mock.Add(100 * time.Millisecond)
+	if got := <-b; !got.Equal(at(400)) {
+		t.Fatalf("b = %v, want %v", got, at(400))
+	}
+}
+
+func TestAllowN(t *testing.T) {
+	clock := newFakeClock()
+	rl := New(10, WithClock(clock), WithoutSlack)
+	a := rl.(BatchAllower)
+	// 新的限制器相当于已经空闲了很久，可以一次放行多个请求
+	if got := rl.(Inspector).RetryAfter(5); got != 0 {
+		t.Fatalf("RetryAfter(5) on a fresh limiter = %v, want 0", got)
+	}
+	if _, ok := a.AllowN(3); !ok {
+		t.Fatalf("AllowN(3) on a fresh limiter was rejected")
+	}
+	if _, ok := a.AllowN(1); ok {
+		t.Fatalf("AllowN(1) right after AllowN(3) was allowed")
+	}
+	if got := rl.(Inspector).RetryAfter(1); got != 100*time.Millisecond {
+		t.Fatalf("RetryAfter(1) = %v, want 100ms", got)
+	}
+	clock.Sleep(300 * time.Millisecond)
+	if _, ok := a.AllowN(2); !ok {
+		t.Fatalf("AllowN(2) after 300ms was rejected")
+	}
+	if _, ok := a.AllowN(0); !ok {
+		t.Fatalf("AllowN(0) was rejected")
+	}
+}
+
+// takeOnly 是只实现了 Take 的 Limiter。
+type takeOnly struct{ l Limiter }
+
+func (t takeOnly) Take() time.Time { return t.l.Take() }
+
+func TestOverloadGuard(t *testing.T) {
+	clock := newFakeClock()
+	rl := New(10, WithClock(clock), WithoutSlack)
+	g := NewOverloadGuard(rl, WithGuardClock(clock),
+		WithGuardThreshold(50*time.Millisecond, time.Second), WithGuardCooldown(500*time.Millisecond))
+	var _ TryTaker = g
+
+	// 等待 0、100ms、100ms，三个样本的平均等待超过 50ms，进入冷却期
+	for i := 0; i < 3; i++ {
+		if _, ok := g.Take(); !ok {
+			t.Fatalf("Take() #%d = false before the guard tripped", i)
+		}
+	}
+	if !g.Overloaded() {
+		t.Fatal("Overloaded() = false after the mean wait exceeded the threshold")
+	}
+	now := clock.Now()
+	if _, ok := g.TryTake(); ok {
+		t.Fatal("TryTake() = true during the cooldown")
+	}
+	if got := clock.Now(); !got.Equal(now) {
+		t.Fatalf("rejected Take waited until %v", got)
+	}
+
+	// 冷却期结束后重新放行，之前的样本已经清空
+	clock.Sleep(500 * time.Millisecond)
+	if g.Overloaded() {
+		t.Fatal("Overloaded() = true after the cooldown")
+	}
+	if _, ok := g.Take(); !ok {
+		t.Fatal("Take() = false after the cooldown")
+	}
+}
+
+func TestOverloadGuardWindow(t *testing.T) {
+	clock := newFakeClock()
+	rl := New(10, WithClock(clock), WithoutSlack)
+	g := NewOverloadGuard(rl, WithGuardClock(clock),
+		WithGuardThreshold(30*time.Millisecond, 500*time.Millisecond))
+
+	// 一次 100ms 的等待，样本不足以判断过载
+	g.Take()
+	g.Take()
+
+	// 它移出窗口之后，只剩下不需要等待的样本，不再计入平均等待
+	clock.Sleep(time.Second)
+	for i := 0; i < 3; i++ {
+		if _, ok := g.Take(); !ok {
+			t.Fatalf("Take() #%d = false", i)
+		}
+		clock.Sleep(100 * time.Millisecond)
+	}
+	if g.Overloaded() {
+		t.Fatal("Overloaded() = true, a wait outside the window was counted")
+	}
+}
+
+func TestBackoffLimiter(t *testing.T) {
+	clock := newFakeClock()
+	rl := New(10, WithClock(clock), WithoutSlack)
+	b := NewBackoffLimiter(rl, WithBackoffClock(clock),
+		WithBackoffAfter(2, time.Millisecond),
+		WithBackoffDelay(10*time.Millisecond, 40*time.Millisecond),
+		WithBackoffFactors(2, 0.5))
+
+	// 第一个请求不阻塞，之后每个请求都要等待；连续阻塞 2 次后开始退避，延迟翻倍直到上限
+	for i, want := range []time.Duration{0, 0, 10, 20, 40, 40} {
+		b.Take()
+		if got := b.Delay(); got != want*time.Millisecond {
+			t.Fatalf("Delay() after take %d = %v, want %v", i, got, want*time.Millisecond)
+		}
+	}
+
+	// 不再阻塞时延迟减半，低于第一次退避的延迟时归零
+	for i, want := range []time.Duration{20, 10, 0} {
+		clock.Sleep(time.Second)
+		b.Take()
+		if got := b.Delay(); got != want*time.Millisecond {
+			t.Fatalf("Delay() after idle take %d = %v, want %v", i, got, want*time.Millisecond)
+		}
+	}
+}
+
+func TestNewErr(t *testing.T) {
+	for _, rate := range []int{0, -1} {
+		if l, err := NewErr(rate); err != ErrInvalidRate || l != nil {
+			t.Fatalf("NewErr(%d) = %v, %v, want nil, ErrInvalidRate", rate, l, err)
+		}
+	}
+	if _, err := NewErr(1); err != nil {
+		t.Fatalf("NewErr(1) error = %v", err)
+	}
+
+	defer func() {
+		if r := recover(); r != ErrInvalidRate.Error() {
+			t.Fatalf("New(0) panicked with %v, want %q", r, ErrInvalidRate.Error())
+		}
+	}()
+	New(0)
+}
+
+func TestSlackRequests(t *testing.T) {
+	for _, n := range []int{0, 3} {
+		clock := newFakeClock()
+		rl := New(10, WithClock(clock), WithSlackRequests(n))
+		rl.Take()
+		clock.Sleep(time.Second)
+
+		// 空闲之后，除了正常放行的一个请求，还可以立即放行 n 个追赶的请求
+		idle := clock.Now()
+		for i := 0; i <= n; i++ {
+			if got := rl.Take(); !got.Equal(idle) {
+				t.Fatalf("WithSlackRequests(%d): take %d = %v, want %v", n, i, got, idle)
+			}
+		}
+		if got, want := rl.Take(), idle.Add(100*time.Millisecond); !got.Equal(want) {
+			t.Fatalf("WithSlackRequests(%d): take after the burst = %v, want %v", n, got, want)
+		}
+	}
+}
+
+func TestRetryAfter(t *testing.T) {
+	clock := newFakeClock()
+	rl := New(10, WithClock(clock))
+	in := rl.(Inspector)
+	if got := in.RetryAfter(1); got != 0 {
+		t.Fatalf("RetryAfter(1) on a fresh limiter = %v, want 0", got)
+	}
+	rl.Take()
+
+	for _, tt := range []struct {
+		count int64
+		want  time.Duration
+	}{
+		{0, 0},
+		{1, 100 * time.Millisecond},
+		{3, 300 * time.Millisecond},
+	} {
+		if got := in.RetryAfter(tt.count); got != tt.want {
+			t.Fatalf("RetryAfter(%d) = %v, want %v", tt.count, got, tt.want)
+		}
+	}
+	// RetryAfter 不改变限制器的状态
+	if got, want := rl.Take(), time.Unix(0, 0).Add(100*time.Millisecond); !got.Equal(want) {
+		t.Fatalf("Take() after RetryAfter = %v, want %v", got, want)
+	}
+
+	// 空闲 1s 之后，默认的富余量可以抵扣 10 个请求的间隔
+	clock.Sleep(time.Second)
+	if got := in.RetryAfter(10); got != 0 {
+		t.Fatalf("RetryAfter(10) after idling = %v, want 0", got)
+	}
+	if got := in.RetryAfter(12); got != 200*time.Millisecond {
+		t.Fatalf("RetryAfter(12) after idling = %v, want 200ms", got)
+	}
+}
+
+func TestOptionalInterfaces(t *testing.T) {
+	var _ Limiter = (*BackoffLimiter)(nil)
+	var _ Limiter = (*PacedLimiter)(nil)
+
+	clock := newFakeClock()
+	l := takeOnly{New(10, WithClock(clock), WithName("inner"))}
+	if _, ok := TryTake(l); !ok {
+		t.Fatalf("TryTake() on a Take-only limiter was rejected")
+	}
+	if _, err := TakeContext(context.Background(), l); err != nil {
+		t.Fatalf("TakeContext() = %v", err)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := TakeContext(ctx, l); err != context.Canceled {
+		t.Fatalf("TakeContext() with a cancelled context = %v", err)
+	}
+	if name := NameOf(l); name != "" {
+		t.Fatalf("NameOf() = %q, want empty", name)
+	}
+	if name := NameOf(LatencyTracked(l.l)); name != "inner" {
+		t.Fatalf("NameOf(LatencyTracked) = %q, want inner", name)
+	}
+}
+
+func BenchmarkTakeContext(b *testing.B) {
+	rl := New(1e9).(ContextTaker)
+	ctx := context.Background()
+	for i := 0; i < b.N; i++ {
+		rl.TakeContext(ctx)
+	}
+}
+
+// BenchmarkTakeContextGoroutine 是每次调用启动一个 goroutine 的朴素实现，作为 TakeContext 的对照。
+func BenchmarkTakeContextGoroutine(b *testing.B) {
+	rl := New(1e9)
+	ctx := context.Background()
+	for i := 0; i < b.N; i++ {
+		done := make(chan time.Time, 1)
+		go func() { done <- rl.Take() }()
+		select {
+		case <-done:
+		case <-ctx.Done():
+		}
+	}
+}
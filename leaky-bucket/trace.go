@@ -0,0 +1,122 @@
+package leakyBucket
+
+import (
+	"context"
+	"time"
+
+	"github.com/gofaquan/leaky-bucket/internal/clock"
+)
+
+// Span 是 Tracer 开始的一个 span，方法与 OpenTelemetry 的 trace.Span 对应。
+type Span interface {
+	// SetAttribute 为 span 设置一个属性，value 为 bool、int64、float64 或 string
+	SetAttribute(key string, value interface{})
+	// End 结束 span
+	End()
+}
+
+// Tracer 开始一个 span，方法与 OpenTelemetry 的 trace.Tracer 对应。
+// 包中不依赖 OpenTelemetry，使用时写一个很小的适配器即可，例如用 attribute.Float64 等转换属性。
+type Tracer interface {
+	Start(ctx context.Context, name string) (context.Context, Span)
+}
+
+// 限流 span 的名字和属性。
+const (
+	SpanName        = "ratelimit.take"
+	AttrWaitMillis  = "ratelimit.wait_ms"   // 等待的时间，单位为毫秒，float64
+	AttrThrottled   = "ratelimit.throttled" // 是否被限流 (需要等待或被拒绝)，bool
+	AttrLimiterName = "ratelimit.name"      // 限制器的名字，见 WithName，string
+)
+
+// TracedLimiter 包装任意 Limiter 限制器，在每次 Take、TakeContext 和 TryTake 时开始一个 span，
+// 记录等待的时间和是否被限流，使限流出现在分布式追踪中。
+// 没有设置 Tracer 时直接调用被包装的限制器，没有额外的开销。
+// 它实现了 ContextTaker、TryTaker 和 Namer，被包装的限制器不支持时按 TakeContext、TryTake 和 NameOf 的方式处理；
+// 其他可选的接口不转发。
+type TracedLimiter struct {
+	Limiter
+	tracer Tracer
+	clock  Clock
+}
+
+// TraceOption 用 Option设计模式 配置一个 TracedLimiter.
+type TraceOption func(t *TracedLimiter)
+
+// WithTracer 返回一个 TraceOption，设置开始 span 的 Tracer。
+func WithTracer(tracer Tracer) TraceOption {
+	return func(t *TracedLimiter) {
+		t.tracer = tracer
+	}
+}
+
+// WithTraceClock 返回一个 TraceOption，用于替换计时的时钟，通常是用于测试的模拟时钟。
+// 它应当与被包装的限制器使用同一个时钟。
+func WithTraceClock(clock Clock) TraceOption {
+	return func(t *TracedLimiter) {
+		t.clock = clock
+	}
+}
+
+// Traced 返回一个包装了 l 的 TracedLimiter。
+func Traced(l Limiter, opts ...TraceOption) *TracedLimiter {
+	t := &TracedLimiter{Limiter: l}
+	for _, opt := range opts {
+		opt(t)
+	}
+	if t.clock == nil {
+		t.clock = clock.New()
+	}
+	return t
+}
+
+// Take 调用被包装的限制器的 Take，以 context.Background() 为父 span 记录等待的时间。
+// 需要把 span 挂在调用者的 trace 上时请使用 TakeContext。
+func (t *TracedLimiter) Take() time.Time {
+	if t.tracer == nil {
+		return t.Limiter.Take()
+	}
+	_, span := t.tracer.Start(context.Background(), SpanName)
+	start := t.clock.Now()
+	at := t.Limiter.Take()
+	t.finish(span, since(t.clock, start), true)
+	return at
+}
+
+// TakeContext 以 TakeContext(ctx, l) 的方式调用被包装的限制器，在 ctx 中的 span 之下记录等待的时间。
+// ctx 被取消时 throttled 属性为 true。
+func (t *TracedLimiter) TakeContext(ctx context.Context) (time.Time, error) {
+	if t.tracer == nil {
+		return TakeContext(ctx, t.Limiter)
+	}
+	ctx, span := t.tracer.Start(ctx, SpanName)
+	start := t.clock.Now()
+	at, err := TakeContext(ctx, t.Limiter)
+	t.finish(span, since(t.clock, start), err == nil)
+	return at, err
+}
+
+// TryTake 以 TryTake(l) 的方式调用被包装的限制器，被拒绝时 throttled 属性为 true。
+func (t *TracedLimiter) TryTake() (time.Time, bool) {
+	if t.tracer == nil {
+		return TryTake(t.Limiter)
+	}
+	_, span := t.tracer.Start(context.Background(), SpanName)
+	start := t.clock.Now()
+	at, ok := TryTake(t.Limiter)
+	t.finish(span, since(t.clock, start), ok)
+	return at, ok
+}
+
+// Name 返回被包装的限制器的名字，见 NameOf。
+func (t *TracedLimiter) Name() string {
+	return NameOf(t.Limiter)
+}
+
+// finish 为 span 设置属性并结束它。
+func (t *TracedLimiter) finish(span Span, wait time.Duration, ok bool) {
+	span.SetAttribute(AttrLimiterName, t.Name())
+	span.SetAttribute(AttrWaitMillis, float64(wait)/float64(time.Millisecond))
+	span.SetAttribute(AttrThrottled, !ok || wait > 0)
+	span.End()
+}
@@ -0,0 +1,38 @@
+package leakyBucket
+
+import "time"
+
+// WeightedTaker 由 New 返回的限制器实现，用于按权重为单个请求计算间隔：
+//
+//	l.(leakyBucket.WeightedTaker).TakeWeighted(2.5)
+type WeightedTaker interface {
+	// TakeWeighted 与 Take 相同，但这个请求占用 w 个请求的间隔
+	TakeWeighted(w float64) time.Time
+}
+
+// TakeWeighted 与 Take 相同，但这个请求与上一个请求之间的间隔是 w * perRequest，用于代价与权重成比例的请求：
+// 权重为 2 的请求要等两个间隔，权重为 0.5 的请求只等半个间隔。
+// 与一次记入多个请求的 AllowN 不同，它只放行一个请求，w 也可以是小数。
+// sleepFor 最多负到 w * maxSlack，即攒下的富余量按同样的比例抵扣这个请求。
+// perRequest 由整数的 rate 计算 (time.Second / rate)，间隔 w * perRequest 向零取整到纳秒，
+// 所以小数权重不会让速率比 rate 更精确，只是在 rate 决定的间隔上按比例缩放。
+// w 不为正时不占用间隔，也不改变限制器的状态，立即返回当前时刻。
+func (t *limiter) TakeWeighted(w float64) time.Time {
+	if !(w > 0) {
+		return t.clock.Now()
+	}
+	t.Lock()
+	now := t.clock.Now()
+	interval := time.Duration(float64(t.interval(now)) * w)
+	maxSlack := time.Duration(float64(t.maxSlack) * w)
+	last, wait := t.reserveInterval(now, interval, maxSlack)
+	clock := t.clock
+	t.Unlock()
+
+	if wait > 0 {
+		clock.Sleep(wait)
+	}
+
+	t.observe(1, wait, true)
+	return last
+}
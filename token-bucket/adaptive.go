@@ -0,0 +1,85 @@
+package tokenBucket
+
+import (
+	"math"
+	"sync"
+)
+
+// AdaptiveLimiter 根据调用者报告的结果，用加性增、乘性减 (AIMD) 的方式调整令牌桶的填充率，
+// 适合在客户端对处理能力多变的下游做自适应限流。
+// 每次 Report(true) 把速率增加 step，直到 maxRate；每次 Report(false) 把速率减半，直到 minRate。
+// 所以持续成功时速率线性地爬升，一出错就迅速回退。
+// 它嵌入了 *Bucket，取令牌的方法与普通的桶相同。
+type AdaptiveLimiter struct {
+	*Bucket
+
+	mu      sync.Mutex
+	minRate float64
+	maxRate float64
+	step    float64
+	// rate 是控制器计算出的速率，applied 是最近一次通过 SetRate 设置到桶上的速率。
+	rate    float64
+	applied float64
+}
+
+// NewAdaptiveLimiter 返回一个在 [minRate, maxRate] 内调整 tb 填充率的 AdaptiveLimiter，
+// 初始速率是 tb 当前的速率 (见 TargetRate) 限制到这个范围内的值。
+// minRate 要为正且不大于 maxRate，step 要为正，否则 panic。
+func NewAdaptiveLimiter(tb *Bucket, minRate, maxRate, step float64) *AdaptiveLimiter {
+	if !(minRate > 0) {
+		panic("token bucket adaptive min rate is not > 0")
+	}
+	if !(maxRate >= minRate) || math.IsInf(maxRate, 1) {
+		panic("token bucket adaptive max rate is not >= min rate")
+	}
+	if !(step > 0) {
+		panic("token bucket adaptive step is not > 0")
+	}
+	a := &AdaptiveLimiter{
+		Bucket:  tb,
+		minRate: minRate,
+		maxRate: maxRate,
+		step:    step,
+	}
+	a.rate = a.clamp(tb.TargetRate())
+	a.applied = a.rate
+	tb.SetRate(a.rate)
+	return a
+}
+
+// Report 报告一次请求的结果：ok 为 true 时增加速率，为 false 时把速率减半。
+// 只有计算出的速率与桶当前的速率相差超过 rateMargin 时才调用 SetRate，
+// 避免每次报告都重新选择填充间隔。SetRate 保留当前间隔中已经过去的时间，
+// 所以即使报告比一个填充间隔更频繁，令牌也仍然按经过的时间补充。
+func (a *AdaptiveLimiter) Report(ok bool) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if ok {
+		a.rate = a.clamp(a.rate + a.step)
+	} else {
+		a.rate = a.clamp(a.rate / 2)
+	}
+	if math.Abs(a.rate-a.applied) > a.applied*rateMargin {
+		a.applied = a.rate
+		a.SetRate(a.rate)
+	}
+}
+
+// AdaptiveRate 返回控制器当前计算出的速率，单位为 令牌/秒。
+// 它可能与 Rate 稍有不同，见 Report。
+func (a *AdaptiveLimiter) AdaptiveRate() float64 {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.rate
+}
+
+// clamp 把 rate 限制在 [minRate, maxRate] 内。
+func (a *AdaptiveLimiter) clamp(rate float64) float64 {
+	if rate < a.minRate {
+		return a.minRate
+	}
+	if rate > a.maxRate {
+		return a.maxRate
+	}
+	return rate
+}
@@ -0,0 +1,34 @@
+package tokenBucket
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// RunAdmissionTest 启动 goroutines 个 goroutine，每个不阻塞地调用 perGoroutine 次 AllowN(1)，
+// 返回一共放行的请求数。所有 goroutine 准备好之后才同时开始，尽量制造竞争。
+// 测试中用模拟时钟固定时间，把结果与理论上限 (初始令牌数加上推进的时间内补充的令牌数) 比较，
+// 可以检查并发时桶不会多放行；也可以作为并发基准测试的脚手架。
+func RunAdmissionTest(tb *Bucket, goroutines, perGoroutine int) (admitted int64) {
+	var (
+		wg    sync.WaitGroup
+		start = make(chan struct{})
+	)
+	wg.Add(goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+			<-start
+			var n int64
+			for j := 0; j < perGoroutine; j++ {
+				if ok, _, _ := tb.AllowN(1); ok {
+					n++
+				}
+			}
+			atomic.AddInt64(&admitted, n)
+		}()
+	}
+	close(start)
+	wg.Wait()
+	return atomic.LoadInt64(&admitted)
+}
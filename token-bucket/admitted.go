@@ -0,0 +1,111 @@
+package tokenBucket
+
+import "time"
+
+// admitSlots 是 WithAdmittedRate 把统计窗口划分成的时间片数。
+const admitSlots = 60
+
+// WithAdmittedRate 返回一个 Option，令桶记录最近 window 时间内每个时间片放行的令牌数，
+// 通过 AdmittedRate 读取实际放行的速率，与配置的速率比较可以发现容量没有被用满。
+// window 被均分为 60 个时间片，时间片的边界由桶的时钟决定。window 不为正时不起作用。
+// 不使用这个 Option 时没有任何开销。
+func WithAdmittedRate(window time.Duration) Option {
+	return func(tb *Bucket) {
+		if window <= 0 {
+			tb.admitted = nil
+			return
+		}
+		slot := window / admitSlots
+		if slot <= 0 {
+			slot = 1
+		}
+		tb.admitted = &admitRing{slot: slot, counts: make([]int64, admitSlots)}
+	}
+}
+
+// AdmittedRate 返回最近 window 时间内实际放行的速率，单位为 令牌/秒。
+// 需要等待的请求在取走令牌时计入。window 超过 WithAdmittedRate 设置的窗口时按那个窗口计算，
+// 桶创建不足 window 时按创建以来的时间计算。没有使用 WithAdmittedRate 时返回 0。
+func (tb *Bucket) AdmittedRate(window time.Duration) float64 {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.admitted == nil || window <= 0 {
+		return 0
+	}
+	return tb.admitted.rate(tb.clock.Now(), window)
+}
+
+// recordAdmit 记录在 now 时刻放行了 count 个令牌，调用者需要持有 tb.mu。
+func (tb *Bucket) recordAdmit(now time.Time, count int64) {
+	if tb.admitted != nil {
+		tb.admitted.add(now, count)
+	}
+}
+
+// admitRing 是按时间片统计放行令牌数的环形缓冲区。
+type admitRing struct {
+	origin  time.Time // 第 0 个时间片的起点，即第一次使用的时刻
+	started bool
+	slot    time.Duration
+	counts  []int64
+	latest  int64 // 最近的时间片的编号，counts[latest%len] 是它的计数
+}
+
+// slotOf 返回 now 所在的时间片的编号，时钟回拨到最近的时间片之前时按最近的时间片处理。
+func (r *admitRing) slotOf(now time.Time) int64 {
+	if !r.started {
+		r.origin = now
+		r.started = true
+	}
+	n := int64(0)
+	if d := now.Sub(r.origin); d > 0 {
+		n = int64(d / r.slot)
+	}
+	if n < r.latest {
+		n = r.latest
+	}
+	return n
+}
+
+// advance 把最近的时间片移动到 n，清零其间过期的时间片。
+func (r *admitRing) advance(n int64) {
+	size := int64(len(r.counts))
+	for i := r.latest + 1; i <= n && i <= r.latest+size; i++ {
+		r.counts[i%size] = 0
+	}
+	if n > r.latest {
+		r.latest = n
+	}
+}
+
+func (r *admitRing) add(now time.Time, count int64) {
+	n := r.slotOf(now)
+	r.advance(n)
+	r.counts[n%int64(len(r.counts))] += count
+}
+
+// rate 返回 now 之前 window 时间内放行的速率。窗口按时间片对齐，
+// 包括当前时间片中已经过去的部分。
+func (r *admitRing) rate(now time.Time, window time.Duration) float64 {
+	n := r.slotOf(now)
+	r.advance(n)
+	size := int64(len(r.counts))
+	k := int64((window + r.slot - 1) / r.slot)
+	if k > size {
+		k = size
+	}
+	if k > n+1 {
+		k = n + 1
+	}
+	var total int64
+	for i := n - k + 1; i <= n; i++ {
+		total += r.counts[i%size]
+	}
+	from := r.origin.Add(time.Duration(n-k+1) * r.slot)
+	elapsed := now.Sub(from)
+	if elapsed <= 0 {
+		// 整个窗口只有刚刚开始的一个时间片，按一个时间片计算
+		elapsed = r.slot
+	}
+	return float64(total) / elapsed.Seconds()
+}
@@ -0,0 +1,26 @@
+package tokenBucket
+
+import "time"
+
+// WithAlignedFill 返回一个 Option，令桶在墙上时钟的边界处填充令牌，
+// 而不是相对创建桶的时刻 (startTime) 每隔 fillInterval 填充。
+// 填充的起点是不晚于创建时刻的、距 Unix 纪元 fillInterval 整数倍的时刻，
+// 例如 fillInterval 为 1s 时在每一秒的开始填充，为 1m 时在每一分钟的开始填充。
+// 只有 fillInterval 能整除一秒、一分钟等单位时，边界才对应人们熟悉的整点；
+// 不同时刻启动的实例只要 fillInterval 相同，填充的时刻就相同，便于比较。
+// 桶仍然以满的状态创建。
+func WithAlignedFill() Option {
+	return func(tb *Bucket) {
+		tb.alignedFill = true
+	}
+}
+
+// alignedStart 返回不晚于 t 的、距 Unix 纪元 interval 整数倍的时刻。
+// 结果由 t 减去偏移得到，保留了 t 的单调时钟读数。
+func alignedStart(t time.Time, interval time.Duration) time.Time {
+	offset := t.Sub(time.Unix(0, 0)) % interval
+	if offset < 0 {
+		offset += interval
+	}
+	return t.Add(-offset)
+}
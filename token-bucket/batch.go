@@ -0,0 +1,87 @@
+package tokenBucket
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// BatchCollector 把一小段时间内到达的大量单个请求合并成一次取令牌，
+// 以增加一点延迟为代价，减少极热的桶上锁的竞争。
+// 第一个请求到达时开始一个批次，window 之后批次中所有的请求一起从桶中取走令牌，
+// 需要等待的时间分发给批次中的每个请求，它们各自等待这段时间后返回。
+// 每个请求取走 defaultCost 个令牌 (默认 1 个，见 WithDefaultCost)。
+type BatchCollector struct {
+	bucket *Bucket
+	window time.Duration
+
+	mu  sync.Mutex
+	cur *batch // 正在收集的批次，为 nil 时下一个请求开始新的批次
+}
+
+// batch 是一个批次的请求，wait 在 done 关闭前写入。
+type batch struct {
+	n    int64
+	wait time.Duration
+	done chan struct{}
+}
+
+// NewBatchCollector 返回一个把 window 时间内的请求合并后从 tb 取令牌的 BatchCollector。
+// window 由桶的时钟度量，不为正时每个批次只等到调度到收集的 goroutine 为止。
+func NewBatchCollector(tb *Bucket, window time.Duration) *BatchCollector {
+	return &BatchCollector{bucket: tb, window: window}
+}
+
+// Acquire 加入下一个批次，等到批次取走令牌并且令牌可用后返回 nil。
+// ctx 在批次取令牌之前被取消时退出批次；之后被取消时归还这个请求的令牌。两种情况都返回 ctx.Err()。
+func (c *BatchCollector) Acquire(ctx context.Context) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	cost := c.bucket.defaultCost
+	c.mu.Lock()
+	b := c.cur
+	if b == nil {
+		b = &batch{done: make(chan struct{})}
+		c.cur = b
+		go c.flush(b)
+	}
+	b.n++
+	c.mu.Unlock()
+
+	select {
+	case <-b.done:
+	case <-ctx.Done():
+		c.mu.Lock()
+		if c.cur == b {
+			// 批次还没有取令牌，直接退出
+			b.n--
+			c.mu.Unlock()
+			return ctx.Err()
+		}
+		c.mu.Unlock()
+		<-b.done
+		c.bucket.Return(cost)
+		return ctx.Err()
+	}
+	if b.wait > 0 {
+		if err := c.bucket.sleepContext(ctx, b.wait); err != nil {
+			c.bucket.Return(cost)
+			return err
+		}
+	}
+	return nil
+}
+
+// flush 在 window 之后结束批次 b，为其中所有的请求一次取走令牌。
+func (c *BatchCollector) flush(b *batch) {
+	if c.window > 0 {
+		c.bucket.currentClock().Sleep(c.window)
+	}
+	c.mu.Lock()
+	c.cur = nil
+	n := b.n
+	c.mu.Unlock()
+	b.wait = c.bucket.Take(n * c.bucket.defaultCost)
+	close(b.done)
+}
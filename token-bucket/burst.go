@@ -0,0 +1,27 @@
+package tokenBucket
+
+// WithBurstTracking 返回一个 Option，令桶记录无需等待就被满足的单次取令牌的最大数量，
+// 通过 MaxObservedBurst 读取。它反映了实际使用到的突发大小，比峰值使用率更适合用来调整容量。
+// 不使用这个 Option 时没有任何开销。
+func WithBurstTracking() Option {
+	return func(tb *Bucket) {
+		tb.burstTracking = true
+	}
+}
+
+// MaxObservedBurst 返回自上一次调用以来，无需等待就被满足的单次取令牌的最大数量，并把记录清零。
+// TakeAvailable 等方法按实际取走的令牌数记录。没有使用 WithBurstTracking 时总是返回 0。
+func (tb *Bucket) MaxObservedBurst() int64 {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	n := tb.maxBurst
+	tb.maxBurst = 0
+	return n
+}
+
+// recordBurst 记录一次无需等待取走了 count 个令牌，调用者需要持有 tb.mu。
+func (tb *Bucket) recordBurst(count int64) {
+	if tb.burstTracking && count > tb.maxBurst {
+		tb.maxBurst = count
+	}
+}
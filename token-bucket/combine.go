@@ -0,0 +1,105 @@
+package tokenBucket
+
+import "sync"
+
+// Allower 是可以组合的非阻塞限制器，And 和 Or 的参数和返回值都是 Allower。
+// *Bucket 实现了这个接口，每次 Allow 占用 defaultCost 个令牌 (默认 1 个，见 WithDefaultCost)。
+type Allower interface {
+	// Allow 不阻塞，能放行一个请求时占用额度并返回 true，否则返回 false 且不占用额度。
+	Allow() bool
+	// Refund 归还一次成功的 Allow 占用的额度。
+	Refund()
+}
+
+// WithDefaultCost 返回一个 Option，设置不带令牌数参数的方法 (如 Allow、Refund)
+// 每次取走或归还的令牌数，默认为 1。
+// 当每次调用的代价从一个令牌变为多个时，调用处不需要修改。n 必须为正。
+func WithDefaultCost(n int64) Option {
+	if n <= 0 {
+		panic("token bucket default cost is not > 0")
+	}
+	return func(tb *Bucket) {
+		tb.defaultCost = n
+	}
+}
+
+// Allow 不阻塞地取走 defaultCost 个令牌，令牌不足时不取走任何令牌并返回 false，实现 Allower 接口。
+func (tb *Bucket) Allow() bool {
+	_, ok := tb.TakeMaxDuration(tb.defaultCost, 0)
+	return ok
+}
+
+// Refund 归还 defaultCost 个令牌，实现 Allower 接口。
+func (tb *Bucket) Refund() {
+	tb.Return(tb.defaultCost)
+}
+
+// And 返回一个只有所有 limiters 都放行时才放行的 Allower。
+// 它按顺序调用每个 limiter 的 Allow，一旦有一个拒绝，
+// 就按相反的顺序 Refund 之前已经放行的 limiter，不留下任何占用。
+func And(limiters ...Allower) Allower {
+	return and(limiters)
+}
+
+type and []Allower
+
+func (a and) Allow() bool {
+	for i, l := range a {
+		if !l.Allow() {
+			for j := i - 1; j >= 0; j-- {
+				a[j].Refund()
+			}
+			return false
+		}
+	}
+	return true
+}
+
+func (a and) Refund() {
+	for i := len(a) - 1; i >= 0; i-- {
+		a[i].Refund()
+	}
+}
+
+// Or 返回一个只要有一个 limiters 放行就放行的 Allower。
+// 它按顺序调用每个 limiter 的 Allow，只占用第一个放行的 limiter 的额度。
+func Or(limiters ...Allower) Allower {
+	return &or{
+		limiters: limiters,
+		charged:  make([]int64, len(limiters)),
+	}
+}
+
+type or struct {
+	limiters []Allower
+
+	mu sync.Mutex
+	// charged 记录每个 limiter 通过 Or 放行、尚未归还的次数。
+	charged []int64
+}
+
+func (o *or) Allow() bool {
+	for i, l := range o.limiters {
+		if l.Allow() {
+			o.mu.Lock()
+			o.charged[i]++
+			o.mu.Unlock()
+			return true
+		}
+	}
+	return false
+}
+
+// Refund 归还一次额度。并发调用时无法知道要撤销的是哪一次 Allow，
+// 所以额度归还给按顺序第一个还有未归还放行的 limiter。
+func (o *or) Refund() {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	for i, n := range o.charged {
+		if n > 0 {
+			o.charged[i]--
+			o.limiters[i].Refund()
+			return
+		}
+	}
+}
@@ -0,0 +1,63 @@
+package tokenBucket
+
+import "time"
+
+// Compute 与 TakeMaxDuration 相同，但使用调用者传入的 now 而不是桶的时钟，
+// 用于自行实现批量调度器等需要确定性地控制时间的场景。
+// now 应当不早于之前传入的时刻；它会修改桶的状态，与其他取令牌的方法一样加锁。
+func (tb *Bucket) Compute(now time.Time, count int64, maxWait time.Duration) (time.Duration, bool) {
+	tb.mu.Lock()
+	d, ok := tb.take(now, count, maxWait)
+	tb.mu.Unlock()
+	tb.observe(count, d, ok)
+	return d, ok
+}
+
+// State 是令牌桶计算令牌时使用的全部状态的快照，见 Bucket.State 和 ComputeTake。
+type State struct {
+	StartTime       time.Time
+	FillInterval    time.Duration
+	Capacity        int64
+	Quantum         int64
+	AvailableTokens int64
+	LatestTick      int64
+	ExactWait       bool
+}
+
+// State 返回桶当前状态的快照。
+// 使用 WithBackgroundRefill 的桶的令牌由后台 goroutine 填充，快照不能用于 ComputeTake。
+func (tb *Bucket) State() State {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return tb.state()
+}
+
+// state 是 State 的内部版本，调用者需要持有 tb.mu。
+func (tb *Bucket) state() State {
+	return State{
+		StartTime:       tb.startTime,
+		FillInterval:    tb.fillInterval,
+		Capacity:        tb.capacity,
+		Quantum:         tb.quantum,
+		AvailableTokens: tb.availableTokens,
+		LatestTick:      tb.latestTick,
+		ExactWait:       tb.exactWait,
+	}
+}
+
+// ComputeTake 是 Take 背后的纯函数：对状态 s 在 now 时刻取走 count 个令牌、最多等待 maxWait，
+// 返回取令牌之后的新状态、需要等待的时间和是否取到了令牌。没有取到时新状态中的令牌数不变，
+// 但和 Take 一样会按 now 补充令牌。它不加锁，也不修改任何桶，调用者自己负责保存和串行化状态。
+func ComputeTake(s State, now time.Time, count int64, maxWait time.Duration) (State, time.Duration, bool) {
+	tb := Bucket{
+		startTime:       s.StartTime,
+		fillInterval:    s.FillInterval,
+		capacity:        s.Capacity,
+		quantum:         s.Quantum,
+		availableTokens: s.AvailableTokens,
+		latestTick:      s.LatestTick,
+		exactWait:       s.ExactWait,
+	}
+	d, ok := tb.take(now, count, maxWait)
+	return tb.state(), d, ok
+}
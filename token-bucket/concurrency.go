@@ -0,0 +1,50 @@
+package tokenBucket
+
+import (
+	"context"
+	"sync"
+)
+
+// ConcurrencyLimiter 同时限制速率和并发：每个请求从令牌桶中取走令牌，
+// 并且最多只有 maxConcurrent 个请求同时在执行，覆盖常见的 "每秒 N 个、最多 M 个并发" 的要求。
+// 令牌一旦取走就被消耗，请求结束时只归还并发名额。
+type ConcurrencyLimiter struct {
+	bucket *Bucket
+	slots  chan struct{}
+}
+
+// NewConcurrencyLimiter 返回一个在 tb 上限速、最多 maxConcurrent 个并发的 ConcurrencyLimiter。
+// maxConcurrent 要为正，否则 panic。每个请求取走 defaultCost 个令牌 (默认 1 个，见 WithDefaultCost)。
+func NewConcurrencyLimiter(tb *Bucket, maxConcurrent int) *ConcurrencyLimiter {
+	if maxConcurrent <= 0 {
+		panic("token bucket max concurrency is not > 0")
+	}
+	return &ConcurrencyLimiter{
+		bucket: tb,
+		slots:  make(chan struct{}, maxConcurrent),
+	}
+}
+
+// Acquire 先等待一个并发名额，再等待令牌可用，成功后返回归还并发名额的 release 函数，
+// 请求结束时必须调用它，重复调用没有影响。
+// 等待期间 ctx 被取消时释放已经得到的名额，并像 WaitContext 一样归还取走的令牌，返回 ctx.Err()。
+func (c *ConcurrencyLimiter) Acquire(ctx context.Context) (release func(), err error) {
+	select {
+	case c.slots <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if err := c.bucket.WaitContext(ctx, c.bucket.defaultCost); err != nil {
+		<-c.slots
+		return nil, err
+	}
+	var once sync.Once
+	return func() {
+		once.Do(func() { <-c.slots })
+	}, nil
+}
+
+// InFlight 返回当前占用并发名额的请求数，包括已经得到名额、正在等待令牌的请求。
+func (c *ConcurrencyLimiter) InFlight() int {
+	return len(c.slots)
+}
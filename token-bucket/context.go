@@ -0,0 +1,120 @@
+package tokenBucket
+
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
+
+// WaitContext 与 Wait 相同，从桶中取走 count 个令牌并等待它们可用，
+// 但 ctx 在等待结束前被取消时把取走的令牌归还给桶，并返回 ctx.Err()。
+// ctx 在调用时已经被取消则不取走令牌。
+// 桶被 Shutdown 时返回 ErrShutdown，同样归还取走的令牌。
+func (tb *Bucket) WaitContext(ctx context.Context, count int64) error {
+	if err := tb.checkWait(ctx); err != nil {
+		return err
+	}
+	if d := tb.Take(count); d > 0 {
+		if err := tb.sleepContext(ctx, d); err != nil {
+			tb.Return(count)
+			return err
+		}
+	}
+	return nil
+}
+
+// Do 等待 count 个令牌可用之后执行 fn，把限流和要做的工作放在一起，
+// 避免调用者忘记取令牌或在等待结束之前就开始工作。
+// 桶被 Shutdown 时不执行 fn，返回 ErrShutdown (见 WaitContext)；否则返回 nil。
+func (tb *Bucket) Do(count int64, fn func()) error {
+	return tb.DoContext(context.Background(), count, fn)
+}
+
+// DoContext 与 Do 相同，但在等待期间 ctx 被取消时不执行 fn，
+// 归还取走的令牌并返回 ctx.Err()，见 WaitContext。
+// ctx 带有截止时间时，等待的时间不能超过截止时间：令牌在截止时间之前不能可用时，
+// 不取走令牌也不执行 fn，立即返回 *ThrottledError，与 TakeErr 相同。
+// 截止时间按系统时钟计算，与桶的时钟无关。
+func (tb *Bucket) DoContext(ctx context.Context, count int64, fn func()) error {
+	if err := tb.checkWait(ctx); err != nil {
+		return err
+	}
+	d, err := tb.takeErr(count, MaxWaitFromContext(ctx, nil))
+	if err != nil {
+		return err
+	}
+	if d > 0 {
+		if err := tb.sleepContext(ctx, d); err != nil {
+			tb.Return(count)
+			return err
+		}
+	}
+	fn()
+	return nil
+}
+
+// MaxWaitFromContext 返回 ctx 的截止时间距 clock 的当前时刻还有多久，可以直接传给 TakeMaxDuration 等方法，
+// 截止时间已过时返回 0；ctx 没有截止时间时返回 time.Duration 的最大值，即不限制等待的时间。
+// clock 为 nil 时使用系统时钟。测试中可以传入桶的伪造时钟，此时截止时间也应当按那个时钟设置。
+func MaxWaitFromContext(ctx context.Context, clock Clock) time.Duration {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		return infinityDuration
+	}
+	if clock == nil {
+		clock = realClock{}
+	}
+	if d := deadline.Sub(clock.Now()); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// checkWait 在开始等待之前检查 ctx 是否已经被取消、桶是否已经被 Shutdown。
+func (tb *Bucket) checkWait(ctx context.Context) error {
+	if tb.IsShutdown() {
+		return ErrShutdown
+	}
+	return ctx.Err()
+}
+
+// sleepContext 在桶的时钟上睡眠 d，ctx 被取消时提前返回 ctx.Err()，桶被 Shutdown 时提前返回 ErrShutdown。
+// 使用系统时钟时用可以停止的定时器等待；伪造的时钟只提供 Sleep，
+// ctx 不能被取消 (ctx.Done() 为 nil) 时直接在调用者的 goroutine 中调用，此时 Shutdown 也不能提前唤醒它；
+// 否则只能在另一个 goroutine 中调用，ctx 被取消后这个 goroutine 仍会睡到 d 结束。
+func (tb *Bucket) sleepContext(ctx context.Context, d time.Duration) error {
+	atomic.AddInt64(&tb.waiters, 1)
+	defer atomic.AddInt64(&tb.waiters, -1)
+
+	clock := tb.currentClock()
+
+	if _, ok := clock.(realClock); ok {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+			return nil
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-tb.shutdown:
+			return ErrShutdown
+		}
+	}
+	if ctx.Done() == nil {
+		clock.Sleep(d)
+		return nil
+	}
+	done := make(chan struct{})
+	go func() {
+		clock.Sleep(d)
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-tb.shutdown:
+		return ErrShutdown
+	}
+}
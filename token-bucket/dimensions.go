@@ -0,0 +1,101 @@
+package tokenBucket
+
+import (
+	"sort"
+	"strconv"
+	"time"
+)
+
+// Dimensions 同时在多个有名字的维度上限流，例如 API 网关同时限制请求数和字节数。
+// 每个维度是一个独立的令牌桶，Allow 只有在每个维度都有足够的额度时才放行，
+// 是 And 推广到每次请求代价不同、维度有名字的情况。用 NewDimensions 返回的 DimensionsBuilder 创建。
+type Dimensions struct {
+	names   []string // 按名字排序，Allow 按这个顺序取令牌
+	buckets map[string]*Bucket
+}
+
+// DimensionsBuilder 逐个注册维度，最后用 Build 创建 Dimensions。
+type DimensionsBuilder struct {
+	buckets map[string]*Bucket
+}
+
+// NewDimensions 返回一个没有任何维度的 DimensionsBuilder。
+func NewDimensions() *DimensionsBuilder {
+	return &DimensionsBuilder{buckets: make(map[string]*Bucket)}
+}
+
+// Add 注册一个每秒填充 rate 个令牌、容量为 capacity 的维度，桶由 NewBucketWithRate 创建，opts 原样传给它。
+// 名字重复时 panic。
+func (b *DimensionsBuilder) Add(name string, rate float64, capacity int64, opts ...Option) *DimensionsBuilder {
+	return b.AddBucket(name, NewBucketWithRate(rate, capacity, opts...))
+}
+
+// AddBucket 把一个已有的桶注册为名为 name 的维度，这个桶也可以在别处使用。名字重复时 panic。
+func (b *DimensionsBuilder) AddBucket(name string, tb *Bucket) *DimensionsBuilder {
+	if _, ok := b.buckets[name]; ok {
+		panic("token bucket dimension " + strconv.Quote(name) + " is already registered")
+	}
+	b.buckets[name] = tb
+	return b
+}
+
+// Build 返回包含已注册的维度的 Dimensions。之后再向 b 注册维度不影响返回的 Dimensions。
+func (b *DimensionsBuilder) Build() *Dimensions {
+	d := &Dimensions{buckets: make(map[string]*Bucket, len(b.buckets))}
+	for name, tb := range b.buckets {
+		d.names = append(d.names, name)
+		d.buckets[name] = tb
+	}
+	sort.Strings(d.names)
+	return d
+}
+
+// Allow 不阻塞地从 costs 中的每个维度取走对应数量的令牌，例如 {"requests": 1, "bytes": 512}。
+// 所有维度都有足够的令牌时返回 true 和 0；否则归还已经从其他维度取走的令牌，
+// 返回 false 和所有维度都有足够令牌还需要等待的最长时间。
+// 代价不为正的维度被忽略，costs 中有没有注册的维度时 panic。
+// 维度按名字的顺序逐个取令牌，并发调用时一个请求失败后归还令牌之前，其他请求可能短暂地看不到这些令牌。
+func (d *Dimensions) Allow(costs map[string]int64) (bool, time.Duration) {
+	for name := range costs {
+		if _, ok := d.buckets[name]; !ok {
+			panic("token bucket dimension " + strconv.Quote(name) + " is not registered")
+		}
+	}
+	for i, name := range d.names {
+		cost := costs[name]
+		if cost <= 0 {
+			continue
+		}
+		if ok, _, _ := d.buckets[name].AllowN(cost); ok {
+			continue
+		}
+		for j := i - 1; j >= 0; j-- {
+			if c := costs[d.names[j]]; c > 0 {
+				d.buckets[d.names[j]].Return(c)
+			}
+		}
+		return false, d.retryAfter(costs)
+	}
+	return true, 0
+}
+
+// retryAfter 返回所有维度都有足够的令牌满足 costs 还需要等待的最长时间。
+func (d *Dimensions) retryAfter(costs map[string]int64) time.Duration {
+	var wait time.Duration
+	for name, cost := range costs {
+		if w := d.buckets[name].RetryAfter(cost); w > wait {
+			wait = w
+		}
+	}
+	return wait
+}
+
+// Bucket 返回名为 name 的维度的桶，没有这个维度时返回 nil。
+func (d *Dimensions) Bucket(name string) *Bucket {
+	return d.buckets[name]
+}
+
+// Names 返回按名字排序的所有维度的名字。
+func (d *Dimensions) Names() []string {
+	return append([]string(nil), d.names...)
+}
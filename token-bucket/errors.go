@@ -0,0 +1,84 @@
+package tokenBucket
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+// ErrShutdown 在桶被 Shutdown 之后由 WaitContext、DoContext 和 TakeErr 返回。
+var ErrShutdown = errors.New("token bucket is shut down")
+
+// Shutdown 用于服务的优雅退出：唤醒所有正在等待令牌的调用者，
+// 之后的等待也立即结束，不必等完可能很长的令牌延迟。
+// WaitContext、DoContext 和 TakeErr 返回 ErrShutdown，之后调用时不再取走令牌；
+// Wait、WaitTotal 等没有错误返回值的方法之后也不取走令牌，直接返回，被唤醒时归还取走的令牌，
+// WaitMaxDuration 返回 false，调用者可以用 IsShutdown 与令牌已经可用的情况区分。
+// 使用伪造的时钟时，只有 ctx 可以被取消的等待会被 Shutdown 唤醒 (见 sleepContext)。
+// 它同时调用 Close 停止后台填充。Shutdown 可以被调用多次，不能撤销。
+func (tb *Bucket) Shutdown() {
+	tb.shutdownOnce.Do(func() {
+		close(tb.shutdown)
+	})
+	tb.Close()
+}
+
+// IsShutdown 报告桶是否已经被 Shutdown。
+func (tb *Bucket) IsShutdown() bool {
+	select {
+	case <-tb.shutdown:
+		return true
+	default:
+		return false
+	}
+}
+
+// ThrottledError 表示请求因为需要等待的时间超过允许的上限而被限流，没有取走任何令牌。
+type ThrottledError struct {
+	retryAfter time.Duration
+}
+
+// Error 实现 error 接口。
+func (e *ThrottledError) Error() string {
+	return "token bucket throttled, retry after " + e.retryAfter.String()
+}
+
+// RetryAfter 返回被拒绝时，要取走同样数量的令牌还需要等待的时间。
+func (e *ThrottledError) RetryAfter() time.Duration {
+	return e.retryAfter
+}
+
+// TakeErr 与 WaitMaxDuration 相同，但用 error 报告结果：
+// 需要等待的时间不超过 maxWait 时取走 count 个令牌，等到令牌可用后返回 nil；
+// 否则立即返回 *ThrottledError，其中带有需要等待的时间，且不取走任何令牌。
+func (tb *Bucket) TakeErr(count int64, maxWait time.Duration) error {
+	if err := tb.checkWait(context.Background()); err != nil {
+		return err
+	}
+	d, err := tb.takeErr(count, maxWait)
+	if err != nil {
+		return err
+	}
+	if d > 0 {
+		return tb.sleepContext(context.Background(), d)
+	}
+	return nil
+}
+
+// takeErr 是不等待的 TakeErr，返回取走令牌后需要等待的时间。
+func (tb *Bucket) takeErr(count int64, maxWait time.Duration) (time.Duration, error) {
+	tb.mu.Lock()
+	now := tb.clock.Now()
+	d, ok := tb.take(now, count, maxWait)
+	var retryAfter time.Duration
+	if !ok {
+		retryAfter = tb.waitTime(now, tb.latestTick, tb.availableTokens-count)
+	}
+	tb.mu.Unlock()
+	tb.observe(count, d, ok)
+
+	if !ok {
+		return 0, &ThrottledError{retryAfter: retryAfter}
+	}
+	return d, nil
+}
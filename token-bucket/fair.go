@@ -0,0 +1,138 @@
+package tokenBucket
+
+import (
+	"container/heap"
+	"sync"
+	"time"
+)
+
+// FairLimiter 让多个 key (如租户) 按权重公平地共享同一个令牌桶的速率。
+// 与每个 key 一个独立的桶不同，所有 key 共用全局的速率，
+// 但请求不是先到先得：每个请求按它所属 key 的权重得到一个虚拟完成时间，
+// 总是先放行虚拟完成时间最早的请求 (加权公平排队，WFQ)。
+// 于是持续积压的 key 按权重比例分到速率，一个 key 的大量请求也不会饿死其他 key。
+type FairLimiter struct {
+	mu      sync.Mutex
+	bucket  *Bucket
+	weights map[string]float64
+
+	// vtime 是最近一个被放行的请求的虚拟完成时间。
+	vtime float64
+	// finish 记录每个 key 最后一个请求的虚拟完成时间，相当于每个 key 的欠额。
+	// key 的最后一个请求被放行后就不再有欠额，它的记录被删除，map 只保存有请求在排队的 key。
+	finish map[string]float64
+	// waiting 是按虚拟完成时间排序的等待队列。
+	waiting fairQueue
+	// seq 为请求编号，虚拟完成时间相同时先到的请求先放行。
+	seq uint64
+	// dispatching 为 true 时有一个 goroutine 正在按顺序放行等待队列中的请求。
+	dispatching bool
+}
+
+// NewFairLimiter 返回一个在 tb 上按 weights 公平调度的 FairLimiter。
+// 不在 weights 中的 key 和权重不为正的 key 的权重按 1 计算。
+func NewFairLimiter(tb *Bucket, weights map[string]float64) *FairLimiter {
+	w := make(map[string]float64, len(weights))
+	for k, v := range weights {
+		w[k] = v
+	}
+	return &FairLimiter{
+		bucket:  tb,
+		weights: w,
+		finish:  make(map[string]float64),
+	}
+}
+
+// Wait 以 key 的身份从桶中取走 count 个令牌，阻塞直到轮到这个请求并且令牌可用。
+func (f *FairLimiter) Wait(key string, count int64) {
+	if count <= 0 {
+		return
+	}
+	w := &fairWaiter{ready: make(chan struct{})}
+
+	f.mu.Lock()
+	weight := f.weights[key]
+	if weight <= 0 {
+		weight = 1
+	}
+	// 空闲了一段时间的 key 从当前的虚拟时间开始计算，不能攒下份额
+	start := f.finish[key]
+	if start < f.vtime {
+		start = f.vtime
+	}
+	w.tag = start + float64(count)/weight
+	w.key = key
+	w.count = count
+	w.seq = f.seq
+	f.seq++
+	f.finish[key] = w.tag
+	heap.Push(&f.waiting, w)
+	if !f.dispatching {
+		f.dispatching = true
+		go f.dispatch()
+	}
+	f.mu.Unlock()
+
+	<-w.ready
+}
+
+// dispatch 依次取出虚拟完成时间最早的请求，在桶上等到它的令牌可用后放行它，
+// 队列为空时退出。
+func (f *FairLimiter) dispatch() {
+	for {
+		f.mu.Lock()
+		if f.waiting.Len() == 0 {
+			f.dispatching = false
+			f.mu.Unlock()
+			return
+		}
+		w := heap.Pop(&f.waiting).(*fairWaiter)
+		f.vtime = w.tag
+		// 这是 key 的最后一个请求时，之后它的请求从 vtime 开始计算，与没有记录相同
+		if f.finish[w.key] <= f.vtime {
+			delete(f.finish, w.key)
+		}
+		f.mu.Unlock()
+
+		f.bucket.Wait(w.count)
+		close(w.ready)
+	}
+}
+
+// fairWaiter 是一个等待放行的请求，FairLimiter 和 TakePriority 共用。
+type fairWaiter struct {
+	// tag 是排序的键，越小越先放行：
+	// FairLimiter 中是虚拟完成时间，TakePriority 中是优先级的相反数。
+	tag   float64
+	seq   uint64
+	count int64
+	ready chan struct{}
+
+	key     string        // 请求所属的 key，仅 FairLimiter 使用
+	start   time.Time     // 开始等待的时刻，仅 TakePriority 使用
+	maxWait time.Duration // 最多等待的时间，仅 TakePriority 使用
+	ok      bool          // 是否取到了令牌，在 ready 关闭前写入
+}
+
+// fairQueue 是按 tag 排序、tag 相同时按 seq 排序的最小堆。
+type fairQueue []*fairWaiter
+
+func (q fairQueue) Len() int { return len(q) }
+
+func (q fairQueue) Less(i, j int) bool {
+	if q[i].tag != q[j].tag {
+		return q[i].tag < q[j].tag
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q fairQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *fairQueue) Push(x interface{}) { *q = append(*q, x.(*fairWaiter)) }
+
+func (q *fairQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return w
+}
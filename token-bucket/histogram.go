@@ -0,0 +1,79 @@
+package tokenBucket
+
+import (
+	"sort"
+	"sync/atomic"
+	"time"
+)
+
+// HistogramBucket 是 LatencyHistogram 中的一个分桶：
+// 等待时间不大于 UpperBound (且大于上一个分桶的 UpperBound) 的 take 次数。
+// 最后一个分桶的 UpperBound 为 time.Duration 的最大值。
+type HistogramBucket struct {
+	UpperBound time.Duration
+	Count      int64
+}
+
+// defaultHistogramBounds 是 WithLatencyHistogram 没有指定分桶边界时使用的边界。
+var defaultHistogramBounds = []time.Duration{
+	time.Millisecond,
+	10 * time.Millisecond,
+	100 * time.Millisecond,
+	time.Second,
+	10 * time.Second,
+}
+
+// WithLatencyHistogram 返回一个 Option，令桶记录每次 take 成功后需要等待的时间的直方图，
+// 通过 LatencyHistogram 读取，无需外部的指标系统就能快速了解限流造成的延迟。
+// bounds 是递增的分桶上界，为空时使用 1ms、10ms、100ms、1s、10s。
+// 不使用这个 Option 时没有任何开销。
+func WithLatencyHistogram(bounds ...time.Duration) Option {
+	if len(bounds) == 0 {
+		bounds = defaultHistogramBounds
+	}
+	b := make([]time.Duration, len(bounds))
+	copy(b, bounds)
+	sort.Slice(b, func(i, j int) bool { return b[i] < b[j] })
+	return func(tb *Bucket) {
+		tb.histogram = &latencyHistogram{
+			bounds: b,
+			counts: make([]int64, len(b)+1),
+		}
+	}
+}
+
+// LatencyHistogram 返回等待时间直方图的快照，reset 为 true 时同时把计数清零。
+// 没有使用 WithLatencyHistogram 时返回 nil。
+func (tb *Bucket) LatencyHistogram(reset bool) []HistogramBucket {
+	h := tb.histogram
+	if h == nil {
+		return nil
+	}
+	snapshot := make([]HistogramBucket, len(h.counts))
+	for i := range h.counts {
+		upper := infinityDuration
+		if i < len(h.bounds) {
+			upper = h.bounds[i]
+		}
+		var n int64
+		if reset {
+			n = atomic.SwapInt64(&h.counts[i], 0)
+		} else {
+			n = atomic.LoadInt64(&h.counts[i])
+		}
+		snapshot[i] = HistogramBucket{UpperBound: upper, Count: n}
+	}
+	return snapshot
+}
+
+// latencyHistogram 用原子计数记录等待时间，不需要加锁。
+type latencyHistogram struct {
+	bounds []time.Duration
+	counts []int64
+}
+
+// record 把等待时间 d 计入对应的分桶。
+func (h *latencyHistogram) record(d time.Duration) {
+	i := sort.Search(len(h.bounds), func(i int) bool { return d <= h.bounds[i] })
+	atomic.AddInt64(&h.counts[i], 1)
+}
@@ -0,0 +1,72 @@
+package tokenBucket
+
+import (
+	"errors"
+	"strconv"
+	"time"
+)
+
+// ErrInvariantChecksDisabled 由没有使用 WithInvariantChecks 创建的桶的 CheckInvariants 返回。
+var ErrInvariantChecksDisabled = errors.New("token bucket invariant checks are not enabled, see WithInvariantChecks")
+
+// invariantState 记录上一次 CheckInvariants 时的起点和 latestTick，用于检查 latestTick 不会减少。
+type invariantState struct {
+	start time.Time
+	tick  int64
+}
+
+// WithInvariantChecks 返回一个 Option，开启 CheckInvariants。
+// 它为桶分配记录上一次检查结果的状态，只用于测试，普通的桶不需要它。
+func WithInvariantChecks() Option {
+	return func(tb *Bucket) {
+		tb.invariants = &invariantState{}
+	}
+}
+
+// CheckInvariants 检查桶内部的状态是否一致，发现问题时返回描述它的错误，否则返回 nil。
+// 它用于属性测试和模糊测试：随机地调用 Take、Return、SetRate 等方法并在每一步之后检查，
+// 可以尽早发现新增的修改令牌数的方法在算术上的错误。
+// 只有用 WithInvariantChecks 创建的桶可以检查，否则返回 ErrInvariantChecksDisabled。
+// 它不修改令牌，但会记录这次检查的起点和 latestTick 供下一次比较，需要加锁，不适合在热路径上调用。
+// 检查的内容包括：
+//   - 可用令牌数不超过容量，容量、quantum 和填充间隔都为正；
+//   - 起点不变时 latestTick 不会减少 (SetRate 和 rebase 会移动起点)；
+//   - latestTick 对应的时间不会溢出，并且在 rebase 之后不超过 rebaseSpan。
+func (tb *Bucket) CheckInvariants() error {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.invariants == nil {
+		return ErrInvariantChecksDisabled
+	}
+
+	bad := func(msg string) error {
+		return errors.New("token bucket invariant violated: " + msg)
+	}
+	if tb.capacity <= 0 || tb.quantum <= 0 || tb.fillInterval <= 0 {
+		return bad("capacity, quantum and fill interval must be > 0")
+	}
+	if tb.availableTokens > tb.capacity {
+		return bad("available tokens " + strconv.FormatInt(tb.availableTokens, 10) +
+			" exceed capacity " + strconv.FormatInt(tb.capacity, 10))
+	}
+	if tb.latestTick < 0 {
+		return bad("latest tick " + strconv.FormatInt(tb.latestTick, 10) + " is negative")
+	}
+	if tb.drainTick > tb.latestTick {
+		return bad("drain tick is after the latest tick")
+	}
+	if tb.startTime.Equal(tb.invariants.start) && tb.latestTick < tb.invariants.tick {
+		return bad("latest tick went backwards from " + strconv.FormatInt(tb.invariants.tick, 10) +
+			" to " + strconv.FormatInt(tb.latestTick, 10))
+	}
+	span := time.Duration(tb.latestTick) * tb.fillInterval
+	if int64(span/tb.fillInterval) != tb.latestTick {
+		return bad("latest tick overflows time.Duration")
+	}
+	if !tb.backgroundRefill && span >= rebaseSpan {
+		return bad("latest tick was not rebased")
+	}
+	tb.invariants.start = tb.startTime
+	tb.invariants.tick = tb.latestTick
+	return nil
+}
@@ -0,0 +1,81 @@
+package tokenBucket
+
+import "io"
+
+// reader 是按字节数限速的 io.Reader，见 NewReader。
+type reader struct {
+	r  io.Reader
+	tb *Bucket
+}
+
+// NewReader 返回一个从 r 读取的 io.ReadCloser，每读到 n 个字节就从 tb 中取走 n 个令牌，
+// 令牌不足时阻塞，从而把读取的带宽限制在桶的速率。
+// 如果 r 实现了 io.Closer，返回值的 Close 方法会关闭 r，否则什么也不做。
+func NewReader(r io.Reader, tb *Bucket) io.ReadCloser {
+	return &reader{r: r, tb: tb}
+}
+
+// Read 先读取，再为实际读到的字节数等待令牌，读取到一部分数据和错误时同样限速。
+func (r *reader) Read(p []byte) (int, error) {
+	n, err := r.r.Read(p)
+	if n > 0 {
+		r.tb.Wait(int64(n))
+	}
+	return n, err
+}
+
+// Close 在底层的 Reader 实现了 io.Closer 时关闭它，否则什么也不做。
+func (r *reader) Close() error {
+	if c, ok := r.r.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
+
+// writer 是按字节数限速的 io.Writer，见 NewWriter。
+type writer struct {
+	w  io.Writer
+	tb *Bucket
+}
+
+// NewWriter 返回一个写入 w 的 io.WriteCloser，写入 n 个字节之前先从 tb 中取走 n 个令牌，
+// 令牌不足时阻塞，从而把写入的带宽限制在桶的速率。
+// 如果 w 实现了 io.Closer，返回值的 Close 方法会关闭 w，否则什么也不做。
+func NewWriter(w io.Writer, tb *Bucket) io.WriteCloser {
+	return &writer{w: w, tb: tb}
+}
+
+// Write 把 p 分成不超过桶容量的若干块，每块先等待令牌再写入，
+// 这样大的写入也会平滑地进行，而不是等待很久之后一次写完。
+// 底层只写入了一部分时，没有写入的字节对应的令牌会归还给桶。
+func (w *writer) Write(p []byte) (int, error) {
+	var written int
+	for len(p) > 0 {
+		chunk := int64(len(p))
+		if c := w.tb.Capacity(); chunk > c {
+			chunk = c
+		}
+		w.tb.Wait(chunk)
+		n, err := w.w.Write(p[:chunk])
+		written += n
+		if int64(n) < chunk {
+			w.tb.Return(chunk - int64(n))
+			if err == nil {
+				err = io.ErrShortWrite
+			}
+		}
+		if err != nil {
+			return written, err
+		}
+		p = p[chunk:]
+	}
+	return written, nil
+}
+
+// Close 在底层的 Writer 实现了 io.Closer 时关闭它，否则什么也不做。
+func (w *writer) Close() error {
+	if c, ok := w.w.(io.Closer); ok {
+		return c.Close()
+	}
+	return nil
+}
@@ -0,0 +1,179 @@
+package tokenBucket
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// 日志记录的类型，每条记录占一行，字段以空格分隔，时间都是 Unix 纳秒：
+//
+//	B <startTime> <fillInterval> <capacity> <quantum> <tokens> <aligned>  创建桶，必须是第一条
+//	T <time> <count>                                                     取走了 count 个令牌 (包括需要等待的)
+//	R <time> <count>                                                     归还了 count 个令牌
+//	S <time> <rate>                                                      SetRate 修改了速率
+//	C <time> <dropped>                                                   桶在 time 填满，丢弃了 dropped 个令牌
+//
+// C 只用于排查问题，Replay 会根据其他记录重新算出它，不依赖它。
+const (
+	journalStart  = 'B'
+	journalTake   = 'T'
+	journalReturn = 'R'
+	journalRate   = 'S'
+	journalClamp  = 'C'
+)
+
+// WithJournal 返回一个 Option，把改变桶中令牌数的每个操作以紧凑的文本记录写入 w，
+// 记录可以用 Replay 回放，重建出桶在最后一条记录时的状态，用于审计和排查限流的争议。
+// 记录在持有桶的锁时写入，w 应当足够快 (例如 bufio.Writer 或内存中的 buffer)；
+// 写入出错后不再记录。时刻以 Unix 纳秒记录，时钟的读数需要在 1678 年到 2262 年之间。
+// 懒惰填充的令牌数只取决于取走和归还的令牌，所以只读取状态的操作 (如 Available) 不会被记录；
+// 使用 WithBackgroundRefill 的桶不能被正确回放。
+func WithJournal(w io.Writer) Option {
+	return func(tb *Bucket) {
+		tb.journal = w
+	}
+}
+
+// Replay 读取 WithJournal 写入的记录，在模拟时钟上依次应用它们，返回重建出的桶。
+// 返回的桶的时钟停在最后一条记录的时刻，不会自己前进，可以用 Available 等方法查看当时的状态。
+// 记录格式错误或第一条不是创建桶的记录时返回错误。
+func Replay(r io.Reader) (*Bucket, error) {
+	clock := &simClock{}
+	var tb *Bucket
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) == 0 {
+			continue
+		}
+		bad := func() (*Bucket, error) {
+			return nil, errors.New("token bucket journal: malformed record at line " + strconv.Itoa(line))
+		}
+		if len(fields[0]) != 1 || len(fields) < 3 {
+			return bad()
+		}
+		kind := fields[0][0]
+		ns, err := strconv.ParseInt(fields[1], 10, 64)
+		if err != nil {
+			return bad()
+		}
+		at := time.Unix(0, ns)
+		if tb == nil && kind != journalStart || tb != nil && kind == journalStart {
+			return bad()
+		}
+		if at.After(clock.now) || tb == nil {
+			clock.now = at
+		}
+
+		switch kind {
+		case journalStart:
+			var v [5]int64
+			if len(fields) != 7 {
+				return bad()
+			}
+			for i := range v {
+				if v[i], err = strconv.ParseInt(fields[i+2], 10, 64); err != nil {
+					return bad()
+				}
+			}
+			if v[0] <= 0 || v[1] <= 0 || v[2] <= 0 || v[3] < 0 {
+				return bad()
+			}
+			tb = newBucket(time.Duration(v[0]), v[1], WithQuantum(v[2]), WithClock(clock), WithInitialTokens(v[3]))
+			tb.alignedFill = v[4] != 0
+		case journalTake, journalReturn, journalClamp:
+			n, err := strconv.ParseInt(fields[2], 10, 64)
+			if err != nil || n < 0 {
+				return bad()
+			}
+			switch kind {
+			case journalTake:
+				tb.adjustavailableTokens(tb.currentTick(clock.now))
+				tb.availableTokens -= n
+			case journalReturn:
+				tb.adjustavailableTokens(tb.currentTick(clock.now))
+				tb.availableTokens = tb.addTokens(tb.availableTokens, n)
+			}
+		case journalRate:
+			rate, err := strconv.ParseFloat(fields[2], 64)
+			if err != nil || !(rate > 0) {
+				return bad()
+			}
+			tb.SetRate(rate)
+		default:
+			return bad()
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if tb == nil {
+		return nil, errors.New("token bucket journal: no start record")
+	}
+	return tb, nil
+}
+
+// journalRecord 写入一条记录，调用者需要持有 tb.mu (或桶尚未被共享)。
+func (tb *Bucket) journalRecord(kind byte, at time.Time, values ...int64) {
+	if tb.journal == nil {
+		return
+	}
+	buf := append(tb.journalBuf[:0], kind, ' ')
+	buf = strconv.AppendInt(buf, at.UnixNano(), 10)
+	for _, v := range values {
+		buf = append(buf, ' ')
+		buf = strconv.AppendInt(buf, v, 10)
+	}
+	tb.journalWrite(append(buf, '\n'))
+}
+
+// journalRate 写入一条 SetRate 的记录，调用者需要持有 tb.mu。
+func (tb *Bucket) journalRate(at time.Time, rate float64) {
+	if tb.journal == nil {
+		return
+	}
+	buf := append(tb.journalBuf[:0], journalRate, ' ')
+	buf = strconv.AppendInt(buf, at.UnixNano(), 10)
+	buf = append(buf, ' ')
+	buf = strconv.AppendFloat(buf, rate, 'g', -1, 64)
+	tb.journalWrite(append(buf, '\n'))
+}
+
+// journalWrite 写入 buf 并保留它以便复用，出错后关闭日志。
+func (tb *Bucket) journalWrite(buf []byte) {
+	tb.journalBuf = buf
+	if _, err := tb.journal.Write(buf); err != nil {
+		tb.journal = nil
+	}
+}
+
+// journalStartRecord 在 init 中写入创建桶的记录，此时 startTime 已经确定。
+func (tb *Bucket) journalStartRecord() {
+	var aligned int64
+	if tb.alignedFill {
+		aligned = 1
+	}
+	tb.journalRecord(journalStart, tb.startTime,
+		int64(tb.fillInterval), tb.capacity, tb.quantum, tb.availableTokens, aligned)
+}
+
+// journalClampRecord 记录补充 intervals 个间隔的令牌时超出容量而被丢弃的令牌，
+// 时刻取第 tick 个间隔的起点。avail 是补充之前的令牌数，调用者需要持有 tb.mu。
+func (tb *Bucket) journalClampRecord(tick, avail, intervals int64) {
+	if tb.journal == nil || intervals <= 0 {
+		return
+	}
+	dropped := int64(math.MaxInt64)
+	if intervals <= math.MaxInt64/tb.quantum {
+		// avail < capacity，所以 capacity - avail 不会溢出
+		dropped = intervals*tb.quantum - (tb.capacity - avail)
+	}
+	if dropped > 0 {
+		tb.journalRecord(journalClamp, tb.startTime.Add(time.Duration(tick)*tb.fillInterval), dropped)
+	}
+}
@@ -0,0 +1,128 @@
+package tokenBucket
+
+import (
+	"context"
+	"time"
+)
+
+// Limiter 包含 leaky-bucket 包中的 Limiter 接口 (只有 Take) 和它的全部可选接口
+// (ContextTaker、TryTaker、BatchAllower、Inspector 和 Namer) 的方法，
+// 所以 AsLimiter 返回的值可以用在任何需要那个 Limiter 的地方，并且支持所有的可选功能。
+type Limiter interface {
+	// Take 阻塞直到请求可以放行，返回放行的时刻
+	Take() time.Time
+	// TakeContext 与 Take 相同，但在 ctx 被取消时停止等待并返回 ctx.Err()
+	TakeContext(ctx context.Context) (time.Time, error)
+	// TryTake 与 Take 相同，但需要等待的时间超过上限时不等待，立即返回 false
+	TryTake() (time.Time, bool)
+	// AllowN 不阻塞，只有在无需等待时才放行 n 个请求并返回放行的时刻，否则返回 false
+	AllowN(n int) (time.Time, bool)
+	// RetryAfter 返回 count 个请求还需要等待多久才能放行，可以立即放行时返回 0
+	RetryAfter(count int64) time.Duration
+	// NextAt 返回下一次 Take 会被放行的时刻，不占用名额
+	NextAt() time.Time
+	// Plan 返回接下来依次调用 n 次 Take 会被放行的时刻，不阻塞也不占用名额
+	Plan(n int) []time.Time
+	// Name 返回限制器的名字，用于在日志和指标中区分多个限制器，没有设置时为空字符串
+	Name() string
+}
+
+// AsLimiter 把令牌桶包装成 Limiter，每个请求取走 defaultCost 个令牌 (默认 1 个，见 WithDefaultCost)。
+// 于是面向简单的 Limiter 接口编写的代码，也可以透明地使用允许突发的令牌桶。
+// 返回的时刻来自桶的时钟，测试中使用伪造的时钟时结果是确定的。
+func AsLimiter(tb *Bucket) Limiter {
+	return bucketLimiter{tb}
+}
+
+type bucketLimiter struct {
+	tb *Bucket
+}
+
+// Take 调用 tb.WaitReturn，返回令牌可用的时刻。
+func (l bucketLimiter) Take() time.Time {
+	return l.tb.WaitReturn(l.tb.defaultCost)
+}
+
+// TakeContext 调用 tb.WaitContext，ctx 在等待结束前被取消时取走的令牌会归还给桶。
+func (l bucketLimiter) TakeContext(ctx context.Context) (time.Time, error) {
+	if err := l.tb.WaitContext(ctx, l.tb.defaultCost); err != nil {
+		return time.Time{}, err
+	}
+	return l.tb.now(), nil
+}
+
+// WithMaxWait 返回一个 Option，限制 AsLimiter 和 Paced 返回的 Limiter 的 TryTake 最多等待 d：
+// 需要等待的时间超过 d 时，TryTake 不取走令牌也不等待，立即返回 false。
+// 不设置时 d 为 0，TryTake 只在无需等待时放行。它不影响 Take 和 TakeContext。d 不能为负。
+func WithMaxWait(d time.Duration) Option {
+	if d < 0 {
+		panic("token bucket max wait is negative")
+	}
+	return func(tb *Bucket) {
+		tb.maxWait = d
+	}
+}
+
+// TryTake 与 tb.WaitMaxDuration 相同，但返回放行的时刻：需要等待的时间超过 WithMaxWait 设置的上限时，
+// 不取走令牌也不等待，立即返回 false。桶被 Shutdown 时同样返回 false。
+func (l bucketLimiter) TryTake() (time.Time, bool) {
+	if l.tb.IsShutdown() {
+		return time.Time{}, false
+	}
+	now := l.tb.now()
+	d, ok := l.tb.TakeMaxDuration(l.tb.defaultCost, l.tb.maxWait)
+	if !ok {
+		return time.Time{}, false
+	}
+	if d > 0 {
+		if err := l.tb.sleep(d); err != nil {
+			l.tb.Return(l.tb.defaultCost)
+			return time.Time{}, false
+		}
+	}
+	return now.Add(d), true
+}
+
+// AllowN 在桶中立即有 n 个请求所需的令牌时取走它们。
+func (l bucketLimiter) AllowN(n int) (time.Time, bool) {
+	if _, ok := l.tb.TakeMaxDuration(int64(n)*l.tb.defaultCost, 0); !ok {
+		return time.Time{}, false
+	}
+	return l.tb.now(), true
+}
+
+// RetryAfter 返回桶中 count 个请求所需的令牌还需要等待的时间。
+func (l bucketLimiter) RetryAfter(count int64) time.Duration {
+	return l.tb.RetryAfter(count * l.tb.defaultCost)
+}
+
+// NextAt 返回桶中有一个请求所需的令牌的时刻。
+func (l bucketLimiter) NextAt() time.Time {
+	return l.tb.now().Add(l.RetryAfter(1))
+}
+
+// Plan 返回桶中依次有 1 到 n 个请求所需的令牌的时刻，与 RetryAfter 的计算方式相同，在一次加锁中完成。
+func (l bucketLimiter) Plan(n int) []time.Time {
+	if n <= 0 {
+		return nil
+	}
+	tb := l.tb
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	now := tb.clock.Now()
+	tokens := tb.tokensAt(now)
+	tick := tb.currentTick(now)
+	plan := make([]time.Time, n)
+	for i := range plan {
+		plan[i] = now
+		if avail := tokens - int64(i+1)*tb.defaultCost; avail < 0 {
+			plan[i] = now.Add(tb.waitTime(now, tick, avail))
+		}
+	}
+	return plan
+}
+
+// Name 返回桶的名字。
+func (l bucketLimiter) Name() string {
+	return l.tb.Name()
+}
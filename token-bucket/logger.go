@@ -0,0 +1,45 @@
+package tokenBucket
+
+import "time"
+
+// 传给 Logger 的日志级别。
+const (
+	LevelDebug = "debug"
+	LevelWarn  = "warn"
+)
+
+// Logger 接收令牌桶的结构化日志，适合没有指标系统、只想记录日志的场景，
+// 可以方便地适配到 zap、logrus 等日志库。level 为 LevelDebug 或 LevelWarn，
+// fields 中包含 name (见 WithName)、count 等字段，Logger 可以持有它。
+// 与 Metrics 一样，Logger 总是在释放锁之后调用。
+type Logger func(level, msg string, fields map[string]interface{})
+
+// WithLogger 返回一个 Option，为令牌桶设置 Logger：
+// 取令牌被拒绝或需要等待时输出 debug 级别的日志，
+// MustBucket 修正了无效的参数时输出 warn 级别的日志。
+// 不设置时没有任何开销。
+func WithLogger(l Logger) Option {
+	return func(tb *Bucket) {
+		tb.logger = l
+	}
+}
+
+// logTake 把一次 take 的结果输出到 Logger，调用者不能持有 tb.mu。
+func (tb *Bucket) logTake(count int64, wait time.Duration, ok bool) {
+	if tb.logger == nil || count <= 0 {
+		return
+	}
+	switch {
+	case !ok:
+		tb.logger(LevelDebug, "token bucket throttled", map[string]interface{}{
+			"name":  tb.name,
+			"count": count,
+		})
+	case wait > 0:
+		tb.logger(LevelDebug, "token bucket waiting for tokens", map[string]interface{}{
+			"name":  tb.name,
+			"count": count,
+			"wait":  wait,
+		})
+	}
+}
@@ -0,0 +1,100 @@
+package tokenBucket
+
+import "time"
+
+// Metrics 接收令牌桶的放行、拒绝和等待事件，用于对接 Prometheus 等指标系统。
+// 它与 leaky-bucket 包中的 Metrics 接口方法完全相同，同一个适配器可以同时用于两种限制器。
+// 回调总是在释放锁之后调用，不会占用限流的临界区。
+type Metrics interface {
+	// Allowed 在 n 个令牌被取走时调用
+	Allowed(n int64)
+	// Throttled 在 n 个令牌没能取走时调用
+	Throttled(n int64)
+	// WaitObserved 报告取走令牌之后需要等待的时间，无需等待时为 0
+	WaitObserved(d time.Duration)
+}
+
+// Observer 是一个简单的回调，在每次取令牌之后以取令牌的结果调用：
+// 取走 (或想要取走) 的令牌数、需要等待的时间以及是否取到了令牌。
+// 与 Metrics 一样，它总是在释放锁之后调用。
+type Observer func(count int64, wait time.Duration, ok bool)
+
+// WithObserver 返回一个 Option，为令牌桶设置 Observer，适合不想实现完整的 Metrics 接口的场景。
+func WithObserver(o Observer) Option {
+	return func(tb *Bucket) {
+		tb.observer = o
+	}
+}
+
+// WithMetrics 返回一个 Option，为令牌桶设置 Metrics。
+func WithMetrics(m Metrics) Option {
+	return func(tb *Bucket) {
+		tb.metrics = m
+	}
+}
+
+// WithPanicHandler 返回一个 Option，设置 Observer、Metrics 和 Logger 等回调 panic 时的处理函数。
+// 回调中的 panic 总是被 recover，不会使取令牌的调用者崩溃，取令牌的结果也不受影响，
+// 只是这一次事件余下的回调不再被调用；设置了 h 时以 recover 的值调用它，便于记录有问题的回调。
+func WithPanicHandler(h func(v interface{})) Option {
+	return func(tb *Bucket) {
+		tb.panicHandler = h
+	}
+}
+
+// recoverCallback 在 observe 等调用回调的方法中被 defer，recover 回调的 panic 并交给 panicHandler。
+func (tb *Bucket) recoverCallback() {
+	if v := recover(); v != nil && tb.panicHandler != nil {
+		tb.panicHandler(v)
+	}
+}
+
+// observe 把一次 take 的结果报告给直方图、Metrics 和 Logger，调用者不能持有 tb.mu。
+func (tb *Bucket) observe(count int64, wait time.Duration, ok bool) {
+	if count <= 0 {
+		return
+	}
+	defer tb.recoverCallback()
+	tb.logTake(count, wait, ok)
+	if tb.observer != nil {
+		tb.observer(count, wait, ok)
+	}
+	if ok && tb.histogram != nil {
+		tb.histogram.record(wait)
+	}
+	if tb.metrics == nil {
+		return
+	}
+	if !ok {
+		tb.metrics.Throttled(count)
+		return
+	}
+	tb.metrics.Allowed(count)
+	tb.metrics.WaitObserved(wait)
+}
+
+// observeAvailable 报告一次 TakeAvailable 的结果：想要 count 个，实际取走 n 个。
+func (tb *Bucket) observeAvailable(count, n int64) {
+	defer tb.recoverCallback()
+	if n < count {
+		tb.logTake(count-n, 0, false)
+	}
+	if tb.observer != nil && count > 0 {
+		if n > 0 {
+			tb.observer(n, 0, true)
+		}
+		if n < count {
+			tb.observer(count-n, 0, false)
+		}
+	}
+	if tb.metrics == nil || count <= 0 {
+		return
+	}
+	if n > 0 {
+		tb.metrics.Allowed(n)
+		tb.metrics.WaitObserved(0)
+	}
+	if n < count {
+		tb.metrics.Throttled(count - n)
+	}
+}
@@ -0,0 +1,50 @@
+package tokenBucket
+
+import (
+	"log"
+	"math"
+)
+
+// minMustRate 是 MustBucket 接受的最小速率：大约每 30 年一个令牌，
+// 再小的速率对应的填充间隔会超出 time.Duration 的范围。
+const minMustRate = 1e-9
+
+// MustBucket 是用于原型和试验的便捷构造函数，不建议在生产环境中使用。
+// 它与 NewBucketWithRate(rate, capacity) 相同，但不会因为参数无效而 panic：
+// rate 不是有限的正数时按每秒 1 个令牌、小于 minMustRate 时按 minMustRate 处理，
+// capacity 不为正时按 1 处理，并输出一条警告：opts 中有 WithLogger 时输出到那个 Logger，
+// 否则用标准库的 log 输出。Logger 中的 panic 与其他回调一样被 recover，交给 WithPanicHandler 设置的函数。
+// 需要在参数无效时报错的场景请使用 NewBucketWithRate 等严格的构造函数。
+func MustBucket(rate float64, capacity int64, opts ...Option) *Bucket {
+	// 先在一个临时的桶上应用 opts，取出其中的 Logger、名字和 panic 的处理函数
+	probe := &Bucket{}
+	for _, opt := range opts {
+		opt(probe)
+	}
+	warn := func(msg string, field string, got, used interface{}) {
+		if probe.logger != nil {
+			defer probe.recoverCallback()
+			probe.logger(LevelWarn, msg, map[string]interface{}{
+				"name":  probe.name,
+				field:   got,
+				"using": used,
+			})
+			return
+		}
+		log.Printf("tokenBucket: %s: %s %v, using %v", msg, field, got, used)
+	}
+
+	switch {
+	case math.IsNaN(rate) || math.IsInf(rate, 0) || rate <= 0:
+		warn("MustBucket rate is not a positive number", "rate", rate, 1)
+		rate = 1
+	case rate < minMustRate:
+		warn("MustBucket rate is too small", "rate", rate, minMustRate)
+		rate = minMustRate
+	}
+	if capacity <= 0 {
+		warn("MustBucket capacity is not > 0", "capacity", capacity, 1)
+		capacity = 1
+	}
+	return NewBucketWithRate(rate, capacity, opts...)
+}
@@ -0,0 +1,143 @@
+package tokenBucket
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Paced 返回一个组合了两种算法的 Limiter：令牌桶 tb 提供突发的额度，
+// 同时相邻两次放行之间至少间隔 minGap，即使桶中攒了很多令牌，请求也会被均匀地放出，
+// 不会在同一时刻一拥而上。每个请求取走 tb 的 defaultCost 个令牌 (见 WithDefaultCost)。
+// 放行的时刻是令牌可用的时刻和上一次放行后 minGap 中较晚的一个。
+func Paced(tb *Bucket, minGap time.Duration) Limiter {
+	return &pacedLimiter{tb: tb, minGap: minGap}
+}
+
+type pacedLimiter struct {
+	tb     *Bucket
+	minGap time.Duration
+
+	mu   sync.Mutex
+	next time.Time // 下一次最早可以放行的时刻
+}
+
+// reserve 在 now 时刻为一个请求取走令牌并安排放行的时刻。
+// 令牌或间隔需要等待的时间超过 maxWait 时不取走令牌也不安排，返回 false。
+func (p *pacedLimiter) reserve(maxWait time.Duration) (now, admit time.Time, ok bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now = p.tb.now()
+	if p.next.Sub(now) > maxWait {
+		return now, time.Time{}, false
+	}
+	d, ok := p.tb.TakeMaxDuration(p.tb.defaultCost, maxWait)
+	if !ok {
+		return now, time.Time{}, false
+	}
+	admit = now.Add(d)
+	if admit.Before(p.next) {
+		admit = p.next
+	}
+	p.next = admit.Add(p.minGap)
+	return now, admit, true
+}
+
+// Take 等待令牌和间隔，返回放行的时刻。
+func (p *pacedLimiter) Take() time.Time {
+	now, admit, _ := p.reserve(infinityDuration)
+	if d := admit.Sub(now); d > 0 {
+		if err := p.tb.sleep(d); err != nil {
+			p.tb.Return(p.tb.defaultCost)
+		}
+	}
+	return admit
+}
+
+// TakeContext 与 Take 相同，但 ctx 在等待结束前被取消时把取走的令牌归还给桶并返回 ctx.Err()。
+// 已经安排的间隔不会归还，之后的请求仍然排在它之后。
+func (p *pacedLimiter) TakeContext(ctx context.Context) (time.Time, error) {
+	if err := ctx.Err(); err != nil {
+		return time.Time{}, err
+	}
+	now, admit, _ := p.reserve(infinityDuration)
+	if d := admit.Sub(now); d > 0 {
+		if err := p.tb.sleepContext(ctx, d); err != nil {
+			p.tb.Return(p.tb.defaultCost)
+			return time.Time{}, err
+		}
+	}
+	return admit, nil
+}
+
+// TryTake 与 Take 相同，但 RetryAfter(1) 超过 tb 的 WithMaxWait 设置的上限时，
+// 不取走令牌也不安排间隔，立即返回 false。桶被 Shutdown 时同样返回 false。
+func (p *pacedLimiter) TryTake() (time.Time, bool) {
+	if p.tb.IsShutdown() {
+		return time.Time{}, false
+	}
+	now, admit, ok := p.reserve(p.tb.maxWait)
+	if !ok {
+		return time.Time{}, false
+	}
+	if d := admit.Sub(now); d > 0 {
+		if err := p.tb.sleep(d); err != nil {
+			p.tb.Return(p.tb.defaultCost)
+			return time.Time{}, false
+		}
+	}
+	return admit, true
+}
+
+// AllowN 只有在距上一次放行已经过了 minGap 并且桶中立即有 n 个请求所需的令牌时才放行。
+// n 个请求一起放行，之后的请求要再等 n 个 minGap。
+func (p *pacedLimiter) AllowN(n int) (time.Time, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.tb.now()
+	if now.Before(p.next) {
+		return time.Time{}, false
+	}
+	if _, ok := p.tb.TakeMaxDuration(int64(n)*p.tb.defaultCost, 0); !ok {
+		return time.Time{}, false
+	}
+	p.next = now.Add(time.Duration(n) * p.minGap)
+	return now, true
+}
+
+// RetryAfter 返回间隔和令牌都满足还需要等待的时间。
+func (p *pacedLimiter) RetryAfter(count int64) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	d := p.tb.RetryAfter(count * p.tb.defaultCost)
+	if gap := p.next.Sub(p.tb.now()); gap > d {
+		d = gap
+	}
+	return d
+}
+
+// NextAt 返回间隔和令牌都满足的时刻。
+func (p *pacedLimiter) NextAt() time.Time {
+	return p.tb.now().Add(p.RetryAfter(1))
+}
+
+// Plan 返回依次放行 n 个请求的时刻：每个时刻是桶中有足够令牌的时刻，
+// 并且与前一次放行至少相隔 minGap。
+func (p *pacedLimiter) Plan(n int) []time.Time {
+	plan := bucketLimiter{p.tb}.Plan(n)
+	p.mu.Lock()
+	next := p.next
+	p.mu.Unlock()
+	for i := range plan {
+		if plan[i].Before(next) {
+			plan[i] = next
+		}
+		next = plan[i].Add(p.minGap)
+	}
+	return plan
+}
+
+// Name 返回桶的名字。
+func (p *pacedLimiter) Name() string {
+	return p.tb.Name()
+}
@@ -0,0 +1,88 @@
+package tokenBucket
+
+import (
+	"container/heap"
+	"time"
+)
+
+// TakePriority 以优先级 prio 从桶中取走 count 个令牌，阻塞直到令牌可用。
+// 令牌充足且没有其他 TakePriority 调用者在等待时立即返回；
+// 否则排入等待队列，桶中令牌不足时优先级高 (prio 大) 的请求先被放行，
+// 优先级相同的按到达顺序放行。
+// 优先级只在 TakePriority 的调用者之间生效，Take、Wait 等方法不经过这个队列。
+func (tb *Bucket) TakePriority(count int64, prio int) {
+	tb.TakePriorityMaxDuration(count, prio, infinityDuration)
+}
+
+// TakePriorityMaxDuration 与 TakePriority 相同，但最多等待 maxWait，返回是否取到了令牌。
+//
+// maxWait 从调用时开始计算，在请求排到队首时检查：
+// 如果已经排队的时间加上还需要等待令牌的时间超过 maxWait，请求放弃并返回 false，不取走任何令牌。
+// 请求排在更高优先级的请求之后时不会被中途唤醒，所以在令牌持续紧张、
+// 高优先级请求不断到达时，低优先级的请求返回 false 之前实际等待的时间可能超过 maxWait。
+func (tb *Bucket) TakePriorityMaxDuration(count int64, prio int, maxWait time.Duration) bool {
+	if count <= 0 {
+		return true
+	}
+
+	tb.prioMu.Lock()
+	if !tb.prioDispatching {
+		// 没有人排队时，令牌充足就直接取走
+		tb.mu.Lock()
+		_, ok := tb.take(tb.clock.Now(), count, 0)
+		tb.mu.Unlock()
+		if ok {
+			tb.prioMu.Unlock()
+			tb.observe(count, 0, true)
+			return true
+		}
+	}
+	w := &fairWaiter{
+		tag:     -float64(prio),
+		seq:     tb.prioSeq,
+		count:   count,
+		start:   tb.now(),
+		maxWait: maxWait,
+		ready:   make(chan struct{}),
+	}
+	tb.prioSeq++
+	heap.Push(&tb.prioWaiting, w)
+	if !tb.prioDispatching {
+		tb.prioDispatching = true
+		go tb.dispatchPriority()
+	}
+	tb.prioMu.Unlock()
+
+	<-w.ready
+	return w.ok
+}
+
+// dispatchPriority 依次取出优先级最高的请求，等到它的令牌可用后放行，队列为空时退出。
+func (tb *Bucket) dispatchPriority() {
+	for {
+		tb.prioMu.Lock()
+		if tb.prioWaiting.Len() == 0 {
+			tb.prioDispatching = false
+			tb.prioMu.Unlock()
+			return
+		}
+		w := heap.Pop(&tb.prioWaiting).(*fairWaiter)
+		tb.prioMu.Unlock()
+
+		remaining := w.maxWait
+		if remaining != infinityDuration {
+			remaining -= tb.now().Sub(w.start)
+		}
+		if remaining >= 0 {
+			d, ok := tb.TakeMaxDuration(w.count, remaining)
+			if ok && d > 0 {
+				if err := tb.sleep(d); err != nil {
+					tb.Return(w.count)
+					ok = false
+				}
+			}
+			w.ok = ok
+		}
+		close(w.ready)
+	}
+}
@@ -1,9 +1,13 @@
 package tokenBucket
 
 import (
+	"context"
+	"io"
 	"math"
+	"runtime"
 	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -18,8 +22,15 @@ import (
 // Bucket 表示以预定速率填充的令牌桶。
 // Bucket 上的方法可以并发调用。
 type Bucket struct {
+	// waiters 记录当前阻塞在 Wait/WaitMaxDuration 中的 goroutine 数量，原子读写。
+	// 它是第一个字段，在 32 位平台上也按 8 字节对齐，不随其他字段的增减而变化。
+	waiters int64
+
 	clock Clock
 
+	// name 是桶的名字，用于在日志和指标中区分多个桶，见 WithName。
+	name string
+
 	// startTime 当第一次创建以及令牌开始进出时 保存桶的时间。
 	startTime time.Time
 
@@ -32,6 +43,9 @@ type Bucket struct {
 	// fillInterval 表示每次填充的时间间隔。
 	fillInterval time.Duration
 
+	// targetRate 是 NewBucketWithRate 或 SetRate 传入的速率，见 TargetRate，其他构造函数创建的桶为 0。
+	targetRate float64
+
 	//用锁保护下面的两个字段
 	mu sync.Mutex
 
@@ -47,16 +61,84 @@ type Bucket struct {
 	// we know the number of tokens in the bucket.
 	//latestTick 持有最新的我们知道桶中的令牌数。
 	latestTick int64
+
+	// drainTick 是最近一次 TakeAvailableRateLimited 时的 tick，
+	// 初始为 -1，使第一次调用可以取走一个 quantum。
+	drainTick int64
+
+	// invariants 是 CheckInvariants 在两次检查之间记录的状态，只在使用 WithInvariantChecks 时分配。
+	invariants *invariantState
+
+	// exactWait 为 true 时，等待时间按连续速率精确计算，见 WithExactWait。
+	exactWait bool
+
+	// maxWait 是 AsLimiter 和 Paced 返回的 Limiter 的 TryTake 最多等待的时间，见 WithMaxWait。
+	maxWait time.Duration
+
+	// metrics 接收放行、拒绝和等待事件，可以为 nil。
+	metrics Metrics
+
+	// observer 在每次取令牌之后被调用，见 WithObserver，可以为 nil。
+	observer Observer
+
+	// logger 接收结构化的日志，见 WithLogger，可以为 nil。
+	logger Logger
+
+	// journal 接收改变令牌数的操作记录，见 WithJournal，可以为 nil。
+	journal    io.Writer
+	journalBuf []byte
+
+	// panicHandler 接收回调中 recover 的 panic，见 WithPanicHandler，可以为 nil。
+	panicHandler func(v interface{})
+
+	// histogram 记录等待时间的直方图，见 WithLatencyHistogram，可以为 nil。
+	histogram *latencyHistogram
+
+	// spinThreshold 是 WaitSpin 忙等的上限，等待时间小于它时不睡眠。
+	spinThreshold time.Duration
+
+	// admitted 统计每个时间片放行的令牌数，见 WithAdmittedRate，可以为 nil。
+	admitted *admitRing
+
+	// burstTracking 为 true 时记录无需等待的最大单次取令牌数 maxBurst，见 WithBurstTracking。
+	burstTracking bool
+	maxBurst      int64
+
+	// defaultCost 是 Allow 等不带令牌数参数的方法每次取走的令牌数，见 WithDefaultCost。
+	defaultCost int64
+
+	// prioMu 保护 TakePriority 的等待队列，prioWaiting 中优先级高的请求先被放行。
+	prioMu          sync.Mutex
+	prioWaiting     fairQueue
+	prioSeq         uint64
+	prioDispatching bool
+
+	// alignedFill 为 true 时填充的起点对齐到 Unix 纪元起 fillInterval 的整数倍，见 WithAlignedFill。
+	alignedFill bool
+
+	// backgroundRefill 为 true 时由后台 goroutine 定时填充令牌，见 WithBackgroundRefill。
+	backgroundRefill bool
+	// closed 在 Close 时关闭，通知后台填充的 goroutine 退出。
+	closed    chan struct{}
+	closeOnce sync.Once
+
+	// shutdown 在 Shutdown 时关闭，唤醒所有正在等待令牌的调用者。
+	shutdown     chan struct{}
+	shutdownOnce sync.Once
 }
 
 // NewBucket 创建指定 填充速率 和 容量大小 的满令牌桶，参数均要为正
-func NewBucket(fillInterval time.Duration, capacity int64) *Bucket {
-	return NewBucketWithClock(fillInterval, capacity, nil)
+// 其余的配置都通过 Option 传入，例如 WithQuantum、WithClock、WithInitialTokens 和 WithObserver，
+// 下面其他的构造函数都是它的简写。
+func NewBucket(fillInterval time.Duration, capacity int64, opts ...Option) *Bucket {
+	tb := newBucket(fillInterval, capacity, opts...)
+	tb.init()
+	return tb
 }
 
 // NewBucketWithClock 和 NewBucket 是一样的，只是加入了一个可测试的时钟接口。
-func NewBucketWithClock(fillInterval time.Duration, capacity int64, clock Clock) *Bucket {
-	return NewBucketWithQuantumAndClock(fillInterval, capacity, 1, clock)
+func NewBucketWithClock(fillInterval time.Duration, capacity int64, clock Clock, opts ...Option) *Bucket {
+	return NewBucketWithQuantumAndClock(fillInterval, capacity, 1, clock, opts...)
 }
 
 // rateMargin 指定允许的误差。1%似乎是合理的。
@@ -64,16 +146,25 @@ const rateMargin = 0.01
 
 // NewBucketWithRate 创建填充速度为指定速率和容量大小的令牌桶
 // NewBucketWithRate(0.1, 200) 表示每秒填充 20 (0.1 * 200) 个令牌
-func NewBucketWithRate(rate float64, capacity int64) *Bucket {
-	return NewBucketWithRateAndClock(rate, capacity, nil)
+func NewBucketWithRate(rate float64, capacity int64, opts ...Option) *Bucket {
+	return NewBucketWithRateAndClock(rate, capacity, nil, opts...)
 }
 
 // NewBucketWithRateAndClock 与 NewBucketWithRate 相同，但加入了一个可测试时钟接口。
-func NewBucketWithRateAndClock(rate float64, capacity int64, clock Clock) *Bucket {
+func NewBucketWithRateAndClock(rate float64, capacity int64, clock Clock, opts ...Option) *Bucket {
 	//每次循环使用相同的桶 (tb)保存分配额。
 	//由 NewBucketWithRate 函数知，按秒填充，每次填充 rate * capacity 个令牌,无消耗则 1 / rate 秒后填满
-	tb := NewBucketWithQuantumAndClock(1, capacity, 1, clock)
+	// quantum 和 fillInterval 由 rate 决定，opts 中的 WithQuantum 不起作用
+	tb := newBucket(1, capacity, append([]Option{WithClock(clock)}, opts...)...)
+	tb.fillInterval, tb.quantum = quantumForRate(rate)
+	tb.targetRate = rate
+	tb.init()
+	return tb
+}
 
+// quantumForRate 返回使填充率在 rate 的 rateMargin 误差内的填充间隔和每次填充的令牌数，
+// 找不到时 panic。
+func quantumForRate(rate float64) (time.Duration, int64) {
 	//待完善,按我的理解应该是通过下面的循环计算方式找到最适合的 quantum fillInterval
 	//使得 capacity / quantum * fillInterval  = 1 / rate
 	for quantum := int64(1); quantum < 1<<50; quantum = nextQuantum(quantum) {
@@ -81,11 +172,9 @@ func NewBucketWithRateAndClock(rate float64, capacity int64, clock Clock) *Bucke
 		if fillInterval <= 0 {
 			continue
 		}
-		tb.fillInterval = fillInterval
-		tb.quantum = quantum
-		//在误差内就返回桶
-		if diff := math.Abs(tb.Rate() - rate); diff/rate <= rateMargin {
-			return tb
+		//在误差内就返回
+		if diff := math.Abs(1e9*float64(quantum)/float64(fillInterval) - rate); diff/rate <= rateMargin {
+			return fillInterval, quantum
 		}
 	}
 	//超过误差允许范围，panic!
@@ -107,44 +196,192 @@ func nextQuantum(q int64) int64 {
 }
 
 // NewBucketWithQuantum 类似于 NewBucket，但可以指定每次填充的令牌量的多少
-func NewBucketWithQuantum(fillInterval time.Duration, capacity, quantum int64) *Bucket {
-	return NewBucketWithQuantumAndClock(fillInterval, capacity, quantum, nil)
+func NewBucketWithQuantum(fillInterval time.Duration, capacity, quantum int64, opts ...Option) *Bucket {
+	return NewBucketWithQuantumAndClock(fillInterval, capacity, quantum, nil, opts...)
 }
 
 // NewBucketWithQuantumAndClock 类似于 NewBucketWithQuantum，
 //加入了一个时钟参数，允许客户端伪造传递时间。如果 clock为 nil，则使用系统时钟。
-func NewBucketWithQuantumAndClock(fillInterval time.Duration, capacity, quantum int64, clock Clock) *Bucket {
-	//判断条件，不满足则添加
-	if clock == nil { //clock 为空，则新建一个
-		clock = realClock{}
-	}
+// 它等同于 NewBucket(fillInterval, capacity, WithQuantum(quantum), WithClock(clock), opts...)。
+func NewBucketWithQuantumAndClock(fillInterval time.Duration, capacity, quantum int64, clock Clock, opts ...Option) *Bucket {
+	return NewBucket(fillInterval, capacity, append([]Option{WithQuantum(quantum), WithClock(clock)}, opts...)...)
+}
+
+// NewUnboundedBurstBucket 创建每 fillInterval 填充 quantum 个令牌、但不限制令牌积累数量的桶，
+// 即允许任意大的突发，只限制长期的总吞吐量。
+// 桶创建时是空的，没有消费者时令牌一直增加，Available 可以无限增长
+// (最多到 math.MaxInt64，长时间空闲也不会溢出)。这样的桶没有有意义的容量，
+// Capacity 返回 math.MaxInt64，Utilization 总是接近 1。
+func NewUnboundedBurstBucket(fillInterval time.Duration, quantum int64, opts ...Option) *Bucket {
+	return NewUnboundedBurstBucketWithClock(fillInterval, quantum, nil, opts...)
+}
+
+// NewUnboundedBurstBucketWithClock 类似于 NewUnboundedBurstBucket，
+// 加入了一个时钟参数，允许客户端伪造传递时间。如果 clock为 nil，则使用系统时钟。
+func NewUnboundedBurstBucketWithClock(fillInterval time.Duration, quantum int64, clock Clock, opts ...Option) *Bucket {
+	return NewBucket(fillInterval, math.MaxInt64,
+		append([]Option{WithQuantum(quantum), WithClock(clock), WithInitialTokens(0)}, opts...)...)
+}
+
+// newBucket 应用 opts 后校验参数并创建桶，但不做依赖 quantum 和 fillInterval 的初始化 (见 init)，
+// 以便 NewBucketWithRateAndClock 在调整好 quantum 和 fillInterval 之后再做。
+func newBucket(fillInterval time.Duration, capacity int64, opts ...Option) *Bucket {
 	if fillInterval <= 0 {
 		panic("token bucket fill interval is not > 0")
 	} //不允许填充间隔为负
 	if capacity <= 0 {
 		panic("token bucket capacity is not > 0")
 	} //不允许容量为负
-	if quantum <= 0 {
-		panic("token bucket quantum is not > 0")
-	} //不允许每次填充令牌为负数
 
-	//满足上述条件后，返回合理的桶
-	return &Bucket{
-		clock:           clock,
-		startTime:       clock.Now(),
+	tb := &Bucket{
 		latestTick:      0,
+		drainTick:       -1,
 		fillInterval:    fillInterval,
 		capacity:        capacity,
-		quantum:         quantum,
+		quantum:         1,
 		availableTokens: capacity,
+		spinThreshold:   defaultSpinThreshold,
+		defaultCost:     1,
+		closed:          make(chan struct{}),
+		shutdown:        make(chan struct{}),
+	}
+	//为上方的桶配置各种可选参数，如下方的 WithExactWait
+	for _, opt := range opts {
+		opt(tb)
+	}
+
+	//判断条件，不满足则添加
+	if tb.clock == nil { //clock 为空，则使用默认的时钟，见 SetDefaultClock
+		tb.clock = defaultClock()
+	}
+	if tb.quantum <= 0 {
+		panic("token bucket quantum is not > 0")
+	} //不允许每次填充令牌为负数
+	if tb.availableTokens < 0 {
+		panic("token bucket initial tokens is negative")
+	}
+	if tb.availableTokens > tb.capacity {
+		tb.availableTokens = tb.capacity
+	}
+	tb.startTime = tb.clock.Now()
+	return tb
+}
+
+// WithQuantum 返回一个 Option，设置每次填充的令牌数，默认为 1，要为正。
+// 对 NewBucketWithRate 创建的桶不起作用，它的 quantum 由速率决定。
+func WithQuantum(quantum int64) Option {
+	return func(tb *Bucket) {
+		tb.quantum = quantum
+	}
+}
+
+// WithClock 返回一个 Option，设置桶使用的时钟，通常是用于测试的伪造时钟。clock 为 nil 时使用默认的时钟 (系统时钟，见 SetDefaultClock)。
+func WithClock(clock Clock) Option {
+	return func(tb *Bucket) {
+		tb.clock = clock
+	}
+}
+
+// WithInitialTokens 返回一个 Option，设置桶创建时的令牌数，默认是满的 (即容量)。
+// n 不能为负，超过容量时按容量处理。
+func WithInitialTokens(n int64) Option {
+	return func(tb *Bucket) {
+		tb.availableTokens = n
+	}
+}
+
+// WithStartEmpty 返回一个 Option，令桶以空的状态创建，从创建时刻开始填充，
+// 等同于 WithInitialTokens(0)。
+func WithStartEmpty() Option {
+	return WithInitialTokens(0)
+}
+
+// WithStartFull 返回一个 Option，令桶以满的状态创建，这是默认的行为，
+// 用于在配置中明确写出意图，或者覆盖之前传入的 WithStartEmpty、WithInitialTokens。
+func WithStartFull() Option {
+	return func(tb *Bucket) {
+		tb.availableTokens = tb.capacity
+	}
+}
+
+// init 在 quantum 和 fillInterval 确定之后完成桶的初始化：
+// 对齐填充的起点 (见 WithAlignedFill)，并启动后台填充 (见 WithBackgroundRefill)。
+func (tb *Bucket) init() {
+	if tb.alignedFill {
+		tb.startTime = alignedStart(tb.startTime, tb.fillInterval)
+	}
+	tb.journalStartRecord()
+	tb.startRefill()
+}
+
+// Option 用 Option设计模式 配置一个 Bucket 令牌桶，所有构造函数都可以传入。
+type Option func(tb *Bucket)
+
+// WithName 返回一个 Option，为桶设置名字，通过 Name 读取。
+// 存在多个桶时，可以用名字标记日志和指标，例如在 Metrics 的实现中按名字区分。
+func WithName(name string) Option {
+	return func(tb *Bucket) {
+		tb.name = name
+	}
+}
+
+// Name 返回用 WithName 设置的名字，没有设置时为空字符串。
+func (tb *Bucket) Name() string {
+	return tb.name
+}
+
+// WithExactWait 返回一个 Option，
+// 令牌不足时按连续的填充速率计算恰好积累够缺少的令牌所需的时间，
+// 而不是把缺少的令牌向上取整到 quantum 的倍数。
+// 对于 quantum 较大的桶，默认的取整可能使等待时间明显偏长。
+func WithExactWait() Option {
+	return func(tb *Bucket) {
+		tb.exactWait = true
 	}
 }
 
 // Wait 取令牌（阻塞）
 // Wait 获取桶中令牌数，等待直到有令牌可用。
+// 桶被 Shutdown 之后不取走令牌，立即返回；等待时被 Shutdown 唤醒则归还取走的令牌，见 WaitContext。
 func (tb *Bucket) Wait(count int64) {
-	if d := tb.Take(count); d > 0 {
-		tb.clock.Sleep(d)
+	tb.WaitContext(context.Background(), count)
+}
+
+// WaitReturn 与 Wait 相同，但返回令牌可用的时刻，即开始等待时时钟的读数加上等待的时间。
+// 与 leaky-bucket 包中 Take 的返回值含义相同，便于用同样的方式记录两种限制器的放行时刻。
+// 它使用桶的时钟，在测试中使用伪造的时钟时结果是确定的。
+// 桶被 Shutdown 时与 Wait 一样不取走 (或归还) 令牌，返回零值。
+func (tb *Bucket) WaitReturn(count int64) time.Time {
+	if tb.IsShutdown() {
+		return time.Time{}
+	}
+	tb.mu.Lock()
+	now := tb.clock.Now()
+	d, _ := tb.take(now, count, infinityDuration)
+	tb.mu.Unlock()
+	tb.observe(count, d, true)
+	if d > 0 {
+		if err := tb.sleep(d); err != nil {
+			tb.Return(count)
+			return time.Time{}
+		}
+	}
+	return now.Add(d)
+}
+
+// WaitNextQuantum 睡眠到下一个填充间隔的边界，即下一次有 quantum 个令牌加入桶中的时刻，
+// 用于让外部的轮询与桶的填充节拍对齐。它使用桶的时钟，不取走令牌；
+// 当前时刻恰好在边界上时立即返回。
+func (tb *Bucket) WaitNextQuantum() {
+	tb.mu.Lock()
+	now := tb.clock.Now()
+	boundary := tb.startTime.Add(time.Duration(tb.currentTick(now)) * tb.fillInterval)
+	if boundary.Before(now) {
+		boundary = boundary.Add(tb.fillInterval)
+	}
+	tb.mu.Unlock()
+	if d := boundary.Sub(now); d > 0 {
+		tb.sleep(d)
 	}
 }
 
@@ -158,14 +395,92 @@ func (tb *Bucket) Wait(count int64) {
 //如果它需要等待的时间 不大于 maxWait才会获取令牌。
 //它检查是否有令牌已经从桶中消耗
 //如果没有令牌被消耗，它立即返回。
+// 桶被 Shutdown 之后不取走令牌，返回 false；等待时被 Shutdown 唤醒则归还取走的令牌，同样返回 false。
 func (tb *Bucket) WaitMaxDuration(count int64, maxWait time.Duration) bool {
+	if tb.IsShutdown() {
+		return false
+	}
 	d, ok := tb.TakeMaxDuration(count, maxWait)
 	if d > 0 {
-		tb.clock.Sleep(d)
+		if err := tb.sleep(d); err != nil {
+			tb.Return(count)
+			return false
+		}
 	}
 	return ok
 }
 
+// defaultSpinThreshold 是 WaitSpin 默认的忙等阈值。
+const defaultSpinThreshold = 100 * time.Microsecond
+
+// WithSpinThreshold 返回一个 Option，设置 WaitSpin 忙等的阈值。
+func WithSpinThreshold(d time.Duration) Option {
+	return func(tb *Bucket) {
+		tb.spinThreshold = d
+	}
+}
+
+// WaitSpin 与 Wait 相同，但需要等待的时间小于忙等阈值时，
+// 会一边调用 runtime.Gosched 一边忙等，而不是调用 clock.Sleep。
+// clock.Sleep 的精度对微秒级的限流来说太粗了，忙等以占用一个 CPU 为代价换取精度，
+// 所以阈值 (见 WithSpinThreshold) 应当设置得尽量小。忙等依赖 clock.Now 随时间前进。
+// Shutdown 的处理与 Wait 相同，忙等不会被 Shutdown 打断。
+func (tb *Bucket) WaitSpin(count int64) {
+	if tb.IsShutdown() {
+		return
+	}
+	d := tb.Take(count)
+	if d <= 0 {
+		return
+	}
+	if d >= tb.spinThreshold {
+		if err := tb.sleep(d); err != nil {
+			tb.Return(count)
+		}
+		return
+	}
+	atomic.AddInt64(&tb.waiters, 1)
+	defer atomic.AddInt64(&tb.waiters, -1)
+	clock := tb.currentClock()
+	deadline := clock.Now().Add(d)
+	for clock.Now().Before(deadline) {
+		runtime.Gosched()
+	}
+}
+
+// WaitTotal 分多次从桶中取走共 total 个令牌，每次最多 chunk 个 (最后一次取剩下的)，
+// 每次取完都用桶的时钟等到令牌可用后再取下一批，直到取够 total 个才返回。
+// chunk <= 0 时一次取走 total 个，相当于 Wait(total)。
+// 桶被 Shutdown 时不再取下一批，已经等到的批次不归还，正在等待的一批与 Wait 一样归还。
+func (tb *Bucket) WaitTotal(total, chunk int64) {
+	if chunk <= 0 {
+		chunk = total
+	}
+	for total > 0 {
+		n := chunk
+		if n > total {
+			n = total
+		}
+		if tb.WaitContext(context.Background(), n) != nil {
+			return
+		}
+		total -= n
+	}
+}
+
+// sleep 用桶的时钟睡眠 d，睡眠期间调用者被计入 Waiters。
+// 被 Shutdown 唤醒时返回 ErrShutdown，调用者需要归还取走的令牌。
+func (tb *Bucket) sleep(d time.Duration) error {
+	return tb.sleepContext(context.Background(), d)
+}
+
+// Waiters 返回当前阻塞在 Wait 或 WaitMaxDuration 中等待令牌的 goroutine 数量。
+// 与 Available 的负值（欠下的令牌数）不同，它统计的是等待者的个数，
+// 可以作为扩容等自动伸缩的信号。
+func (tb *Bucket) Waiters() int {
+	return int(atomic.LoadInt64(&tb.waiters))
+}
+
 const infinityDuration time.Duration = 0x7fffffffffffffff // 2^63 - 1
 
 // Take 取令牌（非阻塞）
@@ -178,8 +493,9 @@ const infinityDuration time.Duration = 0x7fffffffffffffff // 2^63 - 1
 //注意，如果请求是不可撤回的 - 不能返回此方法使用的令牌。
 func (tb *Bucket) Take(count int64) time.Duration {
 	tb.mu.Lock()
-	defer tb.mu.Unlock()
 	d, _ := tb.take(tb.clock.Now(), count, infinityDuration) //infinityDuration 这么大 ，我认为默认一直等待
+	tb.mu.Unlock()
+	tb.observe(count, d, true)
 	return d
 }
 
@@ -199,8 +515,89 @@ func (tb *Bucket) Take(count int64) time.Duration {
 //如果它需要比 maxWait 更长时间使令牌变成可用， 它将返回 false，
 func (tb *Bucket) TakeMaxDuration(count int64, maxWait time.Duration) (time.Duration, bool) {
 	tb.mu.Lock()
-	defer tb.mu.Unlock()
-	return tb.take(tb.clock.Now(), count, maxWait)
+	d, ok := tb.take(tb.clock.Now(), count, maxWait)
+	tb.mu.Unlock()
+	tb.observe(count, d, ok)
+	return d, ok
+}
+
+// TakeWithDebt 立即取走 count 个令牌并返回 true，令牌不足时允许桶中的令牌数变为负数 (欠债)，
+// 但不能低于 -maxDebt；欠下的令牌随着填充自然还清，在此之前其他取令牌的请求需要等待。
+// 与 Wait 不同，它不阻塞，先放行再承担代价，适合可以容忍短时超额的请求。
+// 欠债会超过 maxDebt 时不取走任何令牌并返回 false。
+// 正在 Wait 的调用者欠下的令牌同样计入欠债。maxDebt 为负时按 0 处理。
+func (tb *Bucket) TakeWithDebt(count, maxDebt int64) bool {
+	if count <= 0 {
+		return true
+	}
+	if maxDebt < 0 {
+		maxDebt = 0
+	}
+	tb.mu.Lock()
+	now := tb.clock.Now()
+	tb.adjustavailableTokens(tb.currentTick(now))
+	// 用 availableTokens + maxDebt >= count 判断，避免 availableTokens - count 溢出
+	ok := tb.availableTokens >= count-maxDebt
+	if ok {
+		tb.availableTokens -= count
+		tb.journalRecord(journalTake, now, count)
+		tb.recordAdmit(now, count)
+		tb.recordBurst(count)
+	}
+	tb.mu.Unlock()
+	tb.observe(count, 0, ok)
+	return ok
+}
+
+// TakeAt 为将在 future 时刻执行的任务预订 count 个令牌，不阻塞。
+// 它按填充的节拍计算到 future 时桶中会有多少令牌 (已经被取走和预订的令牌都会扣除)，
+// 足够时立即扣除这些令牌并返回从现在到 future 的时间和 true，
+// 这样提前安排的多批突发不会在同一时刻冲突；不够时不取走任何令牌并返回 false。
+// 与 TakeMaxDuration 不同，它以调用者指定的时刻而不是当前时刻为准。
+// future 不晚于现在时等同于立即取令牌，返回的时间为 0。
+//
+// 预订的令牌现在就被扣除，只有在扣除之后桶到 future 时还没有被填满的情况下，预订才真正占住了 future 的令牌；
+// 否则桶在 future 之前就会补满，扣除的令牌白白少给了现在的调用者，预订的突发却仍然落在满桶上。
+// 所以 future 超过这个补充的视野时也返回 false，不取走任何令牌。
+func (tb *Bucket) TakeAt(future time.Time, count int64) (time.Duration, bool) {
+	if count <= 0 {
+		return 0, true
+	}
+	tb.mu.Lock()
+	now := tb.clock.Now()
+	tb.adjustavailableTokens(tb.currentTick(now))
+	if future.Before(now) {
+		future = now
+	}
+	ok := tb.tokensAt(future) >= count && tb.withinRefillHorizon(future, count)
+	if ok {
+		tb.availableTokens -= count
+		tb.journalRecord(journalTake, now, count)
+		tb.recordAdmit(now, count)
+	}
+	tb.mu.Unlock()
+
+	var d time.Duration
+	if ok {
+		d = future.Sub(now)
+	}
+	tb.observe(count, d, ok)
+	return d, ok
+}
+
+// withinRefillHorizon 报告现在扣除 count 个令牌之后，桶到 future 时是否还没有补满，
+// 即这次扣除在 future 时仍然有效。调用者需要持有 tb.mu，并且已经调用过 adjustavailableTokens。
+func (tb *Bucket) withinRefillHorizon(future time.Time, count int64) bool {
+	if tb.backgroundRefill {
+		return true
+	}
+	// 扣除之后到补满还能补充的令牌数：capacity - (availableTokens - count)，饱和到 math.MaxInt64
+	room := int64(math.MaxInt64)
+	if avail := tb.availableTokens - count; avail >= 0 || tb.capacity <= math.MaxInt64+avail {
+		room = tb.capacity - avail
+	}
+	ticks := tb.currentTick(future) - tb.latestTick
+	return ticks <= (room-1)/tb.quantum
 }
 
 // TakeAvailable 取令牌（非阻塞）
@@ -209,28 +606,125 @@ func (tb *Bucket) TakeMaxDuration(count int64, maxWait time.Duration) (time.Dura
 // no available tokens. It does not block.
 // TakeAvailable 占用可用的令牌桶。它返回被使用的令牌的数量或者 0
 //如果没有可用的令牌。它也不会阻塞。
+//
+// TakeAvailable 不会抢走正在 Wait 的调用者的令牌：Wait 在开始睡眠之前就已经取走了令牌
+// (可用令牌变为负数)，在这些令牌补回来之前 TakeAvailable 取不到任何令牌，
+// 所以两者混用时 Wait 按到达的顺序得到令牌，不需要额外的公平模式。
+// 反复调用 WaitMaxDuration 或 TakeMaxDuration 并因超时而放弃的调用者没有这样的保证，
+// 需要排队时请使用 Wait、TakePriority 或 FairLimiter。
 func (tb *Bucket) TakeAvailable(count int64) int64 {
+	tb.mu.Lock()
+	n := tb.takeAvailable(tb.clock.Now(), count)
+	tb.mu.Unlock()
+	tb.observeAvailable(count, n)
+	return n
+}
+
+// TakeAvailableAt 与 TakeAvailable 相同，但使用传入的时间 now 而不是 clock.Now()，
+// 用于确定性的模拟和测试，见 AllowAt。与 AllowAt 不同，它会取走令牌。
+// now 早于最近一次取令牌的时刻时，按那一刻的令牌数计算。
+func (tb *Bucket) TakeAvailableAt(now time.Time, count int64) int64 {
+	tb.mu.Lock()
+	n := tb.takeAvailable(now, count)
+	tb.mu.Unlock()
+	tb.observeAvailable(count, n)
+	return n
+}
+
+// TakeAvailableRateLimited 与 TakeAvailable 相同，但取走的令牌数还不超过
+// 从上一次调用以来经过的填充间隔数乘以 quantum (第一次调用按一个间隔计算)，
+// 即使桶是满的也不会一次取走全部的令牌，为允许突发的桶提供一种平滑的取令牌方式。
+// 同一个间隔内再次调用时最多取走 0 个令牌；没有用完的额度不会累积到下一次。
+// 这个额度只约束 TakeAvailableRateLimited 自己，其他取令牌的方法不受影响。
+func (tb *Bucket) TakeAvailableRateLimited(count int64) int64 {
+	tb.mu.Lock()
+	now := tb.clock.Now()
+	tb.adjustavailableTokens(tb.currentTick(now))
+	tick := tb.latestTick
+	var allowance int64
+	if intervals := tick - tb.drainTick; intervals > 0 {
+		allowance = math.MaxInt64
+		if intervals <= math.MaxInt64/tb.quantum {
+			allowance = intervals * tb.quantum
+		}
+	}
+	if tick > tb.drainTick {
+		tb.drainTick = tick
+	}
+	want := count
+	if want > allowance {
+		want = allowance
+	}
+	n := tb.takeAvailable(now, want)
+	tb.mu.Unlock()
+	tb.observeAvailable(count, n)
+	return n
+}
+
+// TakeMany 为 n 个各需要一个令牌的候选请求做准入控制：不阻塞地放行其中尽可能多的请求，
+// 返回放行的个数 (0 到 n 之间)，调用者可以让前这么多个请求继续执行。
+// 它等同于 TakeAvailable(int64(n))，在一次加锁中完成。
+func (tb *Bucket) TakeMany(n int) int {
+	return int(tb.TakeAvailable(int64(n)))
+}
+
+// TakeAvailableFloor 与 TakeAvailable 相同，但只会取走高于 floor 的那部分令牌，
+// 桶中始终为其他 (如对延迟敏感的) 请求保留至少 floor 个令牌。
+// 它返回被取走的令牌数量，没有高于 floor 的令牌时返回 0。它也不会阻塞。
+// floor 为负时按 0 处理，与 TakeAvailable 相同，不会因此取走桶中没有的令牌。
+func (tb *Bucket) TakeAvailableFloor(count, floor int64) int64 {
+	tb.mu.Lock()
+	n := tb.takeAvailableFloor(tb.clock.Now(), count, floor)
+	tb.mu.Unlock()
+	tb.observeAvailable(count, n)
+	return n
+}
+
+// DrainTo 取走令牌直到桶中只剩下 level 个，返回取走的令牌数。
+// 当前可用的令牌数已经不大于 level 时什么也不做并返回 0。
+// 可以用来在测试中构造已知的初始状态，或者有意地减少余量。
+func (tb *Bucket) DrainTo(level int64) int64 {
 	tb.mu.Lock()
 	defer tb.mu.Unlock()
-	return tb.takeAvailable(tb.clock.Now(), count)
+	now := tb.clock.Now()
+	tb.adjustavailableTokens(tb.currentTick(now))
+	if tb.availableTokens <= level {
+		return 0
+	}
+	n := tb.availableTokens - level
+	tb.availableTokens = level
+	tb.journalRecord(journalTake, now, n)
+	return n
 }
 
 // takeAvailable 是 TakeAvailable 的内部版本
 //它接受当前时间作为参数，以方便测试。
 func (tb *Bucket) takeAvailable(now time.Time, count int64) int64 {
+	return tb.takeAvailableFloor(now, count, 0)
+}
+
+// takeAvailableFloor 是 TakeAvailableFloor 的内部版本，floor 为 0 时即 takeAvailable。
+func (tb *Bucket) takeAvailableFloor(now time.Time, count, floor int64) int64 {
 	if count <= 0 { // 取走 0 个令牌
 		return 0 // 表明立即取走
 	}
 	tb.adjustavailableTokens(tb.currentTick(now)) //调整令牌数
 
-	if tb.availableTokens <= 0 { //发现无可以令牌
+	if floor < 0 {
+		floor = 0
+	}
+	avail := tb.availableTokens - floor // 高于 floor 的令牌才可以取
+	if avail <= 0 {                     //发现无可以令牌
 		return 0
 	}
-	if count > tb.availableTokens { //现有令牌不够取
-		count = tb.availableTokens //能取多少取多少
+	if count > avail { //现有令牌不够取
+		count = avail //能取多少取多少
 	}
 	tb.availableTokens -= count // 可用令牌 = 可用令牌 - 需要的令牌数
-	return count                //返回取走令牌数
+	tb.journalRecord(journalTake, now, count)
+	tb.recordAdmit(now, count)
+	tb.recordBurst(count)
+	return count //返回取走令牌数
 }
 
 // Available returns the number of available tokens. It will be negative
@@ -245,7 +739,7 @@ func (tb *Bucket) takeAvailable(now time.Time, count int64) int64 {
 //因为可用的令牌数量可能在此期间发生了变化。
 //这个方法的目的是主要用于度量报告和调试。
 func (tb *Bucket) Available() int64 {
-	return tb.available(tb.clock.Now())
+	return tb.available(tb.now())
 }
 
 // available 是 Available 的内部版本-它加入以当前时间为一个参数，使易于测试。
@@ -256,13 +750,231 @@ func (tb *Bucket) available(now time.Time) int64 {
 	return tb.availableTokens
 }
 
+// Return 把 count 个已经取走的令牌归还给桶，用于撤销一次取令牌的操作。
+// 归还前先按当前时间补充令牌，归还后的令牌数不会超过桶的容量。
+func (tb *Bucket) Return(count int64) {
+	if count <= 0 {
+		return
+	}
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	now := tb.clock.Now()
+	tb.adjustavailableTokens(tb.currentTick(now))
+	tb.availableTokens = tb.addTokens(tb.availableTokens, count)
+	tb.journalRecord(journalReturn, now, count)
+}
+
+// RetryAfter 返回现在要取走 count 个令牌还需要等待多久，可以立即取走时返回 0。
+// 它不取走令牌，也不修改桶的状态，适合用来设置 HTTP 的 Retry-After 头。
+func (tb *Bucket) RetryAfter(count int64) time.Duration {
+	if count <= 0 {
+		return 0
+	}
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	now := tb.clock.Now()
+	avail := tb.tokensAt(now) - count
+	if avail >= 0 {
+		return 0
+	}
+	return tb.waitTime(now, tb.currentTick(now), avail)
+}
+
+// TimeToFull 返回按当前的速率，桶中的令牌从现在补充到容量还需要多久，已经满了时返回 0。
+// 缺少的令牌向上取整到 quantum 的倍数，按填充的节拍计算到填满的那个间隔的起点，
+// 所以当前间隔中已经过去的时间会被扣除。它不修改桶中的令牌数，适合在仪表盘上展示恢复的进度。
+// 使用 WithBackgroundRefill 时同样按节拍估算。
+func (tb *Bucket) TimeToFull() time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	now := tb.clock.Now()
+	tb.adjustavailableTokens(tb.currentTick(now))
+	if tb.availableTokens >= tb.capacity {
+		return 0
+	}
+	missing := tb.capacity - tb.availableTokens
+	endTick := tb.latestTick + (missing-1)/tb.quantum + 1
+	if d := tb.startTime.Add(time.Duration(endTick) * tb.fillInterval).Sub(now); d > 0 {
+		return d
+	}
+	return 0
+}
+
+// MaxBurstDuration 返回一次用完全部容量的突发之后，桶从空补充到满需要多久，
+// 即 capacity/quantum (向上取整) 个填充间隔，溢出时返回 time.Duration 的最大值。
+// 它只由配置决定，与桶中当前的令牌数无关，适合在 /debug 接口和容量评估中说明桶的恢复时间。
+// 与 Capacity 和 Rate 一样加锁读取，以便与 SetRate 并发调用时是安全的。
+func (tb *Bucket) MaxBurstDuration() time.Duration {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	ticks := (tb.capacity-1)/tb.quantum + 1
+	if ticks > int64(infinityDuration/tb.fillInterval) {
+		return infinityDuration
+	}
+	return time.Duration(ticks) * tb.fillInterval
+}
+
+// AllowN 在一次加锁中尝试立即取走 n 个令牌，并返回一致的三元组：
+// 是否取到了令牌、之后桶中剩余的令牌数 (有消费者在等待时为 0)，
+// 以及没有取到时还需要等待多久 (取到时为 0)。
+// 适合在一个处理函数中同时设置 X-RateLimit-Remaining 和 Retry-After 头，
+// 分别调用 Allow、Available 和 RetryAfter 的结果之间可能有其他请求插入。
+func (tb *Bucket) AllowN(n int64) (ok bool, remaining int64, retryAfter time.Duration) {
+	tb.mu.Lock()
+	now := tb.clock.Now()
+	_, ok = tb.take(now, n, 0)
+	remaining = tb.availableTokens
+	if !ok {
+		retryAfter = tb.waitTime(now, tb.latestTick, remaining-n)
+	}
+	tb.mu.Unlock()
+
+	if remaining < 0 {
+		remaining = 0
+	}
+	tb.observe(n, 0, ok)
+	return ok, remaining, retryAfter
+}
+
+// AllowAt 检查在 now 时刻桶中是否有 count 个令牌可以立即取走，但不取走令牌，也不修改桶的任何状态。
+// 它使用传入的时间而不是 clock.Now()，用于确定性的模拟和测试。
+// now 早于最近一次取令牌的时刻时，按那一刻的令牌数计算。
+func (tb *Bucket) AllowAt(now time.Time, count int64) bool {
+	if count <= 0 {
+		return true
+	}
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return tb.tokensAt(now) >= count
+}
+
+// tokensAt 返回 now 时刻可用的令牌数，是不修改桶状态的 adjustavailableTokens。
+// 调用者需要持有 tb.mu。
+func (tb *Bucket) tokensAt(now time.Time) int64 {
+	avail := tb.availableTokens
+	tick := tb.currentTick(now)
+	if tb.backgroundRefill || avail >= tb.capacity || tick <= tb.latestTick {
+		return avail
+	}
+	return tb.refillTokens(avail, tick-tb.latestTick)
+}
+
+// Utilization 返回桶当前的使用率 1 - available/capacity，便于在仪表盘上比较容量不同的桶。
+// 它在锁内先按当前时间补充令牌再计算，结果限制在 [0, 1] 内：
+// 有消费者在等待令牌 (可用令牌为负) 时返回 1。
+func (tb *Bucket) Utilization() float64 {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	tb.adjustavailableTokens(tb.currentTick(tb.clock.Now()))
+	u := 1 - float64(tb.availableTokens)/float64(tb.capacity)
+	if u < 0 {
+		return 0
+	}
+	if u > 1 {
+		return 1
+	}
+	return u
+}
+
 // Capacity 返回创建桶时使用的容量。
+// 加锁读取，以便与动态修改配置的方法并发调用时是安全的。
 func (tb *Bucket) Capacity() int64 {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
 	return tb.capacity
 }
 
 // Rate 返回桶的填充率，单位为 令牌/秒。
+// 同 Capacity 一样加锁读取。
 func (tb *Bucket) Rate() float64 {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return tb.rate()
+}
+
+// SetRate 把桶的填充率修改为 rate 令牌/秒，与 NewBucketWithRate 一样选择填充间隔和每次填充的令牌数。
+// 修改前先按旧的速率补充令牌到现在，桶中的令牌 (包括欠下的令牌) 保持不变；
+// 当前间隔中已经过去的时间计入新的第一个间隔，所以频繁地调用 SetRate 不会让桶一直得不到补充。
+// rate 不为正时 panic。
+func (tb *Bucket) SetRate(rate float64) {
+	if !(rate > 0) {
+		panic("token bucket rate is not > 0")
+	}
+	fillInterval, quantum := quantumForRate(rate)
+
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	now := tb.clock.Now()
+	tb.adjustavailableTokens(tb.currentTick(now))
+	elapsed := now.Sub(tb.startTime.Add(time.Duration(tb.latestTick) * tb.fillInterval))
+	if elapsed < 0 {
+		elapsed = 0
+	}
+	tb.fillInterval = fillInterval
+	tb.quantum = quantum
+	tb.targetRate = rate
+	tb.startTime = now.Add(-elapsed)
+	if tb.alignedFill {
+		tb.startTime = alignedStart(now, fillInterval)
+	}
+	tb.latestTick = 0
+	tb.drainTick = -1
+	tb.journalRate(now, rate)
+}
+
+// SetClock 把桶的时钟替换为 clock，例如在集成测试中先用真实的时钟启动，再换成模拟时钟控制时间。
+// 替换前先按旧的时钟补充令牌到现在，然后把起点平移到新的时钟上与现在相距同样远的地方：
+// 桶中的令牌 (包括欠下的令牌) 不变，当前填充间隔中已经过去的部分也保留，
+// 所以在新的时钟上还要再经过同样长的时间才会补充下一批令牌，就像时钟没有被替换过一样。
+// WithAlignedFill 的填充边界随起点一起平移，不再对齐。
+// 它可以在桶被其他 goroutine 使用时调用：不持有锁的代码都通过 currentClock 读取时钟，
+// 但已经开始睡眠的调用者仍在旧的时钟上睡到结束。
+func (tb *Bucket) SetClock(clock Clock) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	old := tb.clock.Now()
+	tb.adjustavailableTokens(tb.currentTick(old))
+	// 两个时钟可能相差数百年，超出 time.Duration 的范围，所以不计算它们的差，
+	// 而是在新的时钟上保持起点到现在的距离 (rebase 保证它不超过 rebaseSpan)
+	now := clock.Now()
+	checked := tb.invariants != nil && tb.invariants.start.Equal(tb.startTime)
+	tb.startTime = now.Add(-old.Sub(tb.startTime))
+	if checked {
+		tb.invariants.start = tb.startTime
+	}
+	if tb.admitted != nil && tb.admitted.started {
+		tb.admitted.origin = now.Add(-old.Sub(tb.admitted.origin))
+	}
+	tb.clock = clock
+}
+
+// currentClock 在锁内读取桶的时钟。时钟可能被 SetClock 并发地替换，
+// 不持有 tb.mu 的代码都要通过它或 now 读取时钟，调用者不能持有 tb.mu。
+func (tb *Bucket) currentClock() Clock {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	return tb.clock
+}
+
+// now 返回桶的时钟的当前时刻，见 currentClock。
+func (tb *Bucket) now() time.Time {
+	return tb.currentClock().Now()
+}
+
+// TargetRate 返回创建桶 (NewBucketWithRate) 或 SetRate 时指定的速率，单位为 令牌/秒。
+// Rate 返回的是由 quantum 和 fillInterval 实际实现的速率，与指定的速率最多相差 rateMargin，
+// 用于展示时 TargetRate 与用户的配置一致。用其他构造函数创建的桶返回与 Rate 相同的值。
+func (tb *Bucket) TargetRate() float64 {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+	if tb.targetRate > 0 {
+		return tb.targetRate
+	}
+	return tb.rate()
+}
+
+// rate 是 Rate 的内部版本，调用者需要持有 tb.mu (或桶尚未被共享)。
+func (tb *Bucket) rate() float64 {
 	//一次 quantum 个，fillInterval 秒，速率是quantum/fillInterval
 	return 1e9 * float64(tb.quantum) / float64(tb.fillInterval)
 }
@@ -274,17 +986,43 @@ func (tb *Bucket) take(now time.Time, count int64, maxWait time.Duration) (time.
 		return 0, true //表明过了 0 ns 立即成功，能取走
 	}
 
-	tick := tb.currentTick(now)    // 走了 tick 个 时间间隔(fillInterval)
-	tb.adjustavailableTokens(tick) //调整令牌数量
+	tb.adjustavailableTokens(tb.currentTick(now)) //调整令牌数量
+	tick := tb.latestTick                         // 走了 tick 个 时间间隔(fillInterval)，起点可能已经被 rebase 移动
 
 	avail := tb.availableTokens - count // 可用令牌 - 要的令牌数
 	//1. 令牌足够
 	if avail >= 0 {
 		tb.availableTokens = avail // 可用令牌  = 可用令牌 - 要的令牌数
-		return 0, true             //表明过了 0 ns 立即成功，能取走
+		tb.journalRecord(journalTake, now, count)
+		tb.recordAdmit(now, count)
+		tb.recordBurst(count)
+		return 0, true //表明过了 0 ns 立即成功，能取走
 	}
 
 	//2.令牌不足
+	waitTime := tb.waitTime(now, tick, avail)
+	// 等待超时
+	if waitTime > maxWait {
+		return 0, false //表明过了 0 ns 立即失败，不能取走
+	}
+	tb.availableTokens = avail
+	tb.journalRecord(journalTake, now, count)
+	tb.recordAdmit(now, count)
+	return waitTime, true //表明过了 waitTime 成功，能取走
+}
+
+// waitTime 返回在 now 时刻 (处于第 tick 个间隔) 令牌数为 avail (< 0) 时，
+// 需要等待多久令牌数才能回到 0。
+func (tb *Bucket) waitTime(now time.Time, tick, avail int64) time.Duration {
+	if tb.exactWait {
+		// 从当前间隔的起点开始按连续速率积累 -avail 个令牌，所需时间减去本间隔已过去的时间
+		tickTime := tb.startTime.Add(time.Duration(tick) * tb.fillInterval)
+		need := time.Duration(float64(-avail) * float64(tb.fillInterval) / float64(tb.quantum))
+		if waitTime := tickTime.Add(need).Sub(now); waitTime > 0 {
+			return waitTime
+		}
+		return 0
+	}
 	//将缺失的令牌四舍五入到最近的 quantum 的倍数
 	//令牌将无法使用，直到过了 上方的时间间隔倍数 的时间，使得令牌足够
 	// endTick = 令牌数 达到 能够取走的数目(count) 的 时间间隔总数
@@ -292,33 +1030,77 @@ func (tb *Bucket) take(now time.Time, count int64, maxWait time.Duration) (time.
 	// 等待结束的时间 = endTime = startTime + 间隔数time.Duration(endTick) * 每个间隔经过的时间(fillInterval)
 	endTime := tb.startTime.Add(time.Duration(endTick) * tb.fillInterval)
 	// 等待的时间 = waitTime = endTime - take传入参数的开始时间(now)
-	waitTime := endTime.Sub(now)
-	// 等待超时
-	if waitTime > maxWait {
-		return 0, false //表明过了 0 ns 立即失败，不能取走
-	}
-	tb.availableTokens = avail
-	return waitTime, true //表明过了 waitTime 成功，能取走
+	return endTime.Sub(now)
 }
 
 // currentTick 返回当前进过的时间间隔数，测量从 startTime 到现在过了几个间隔
+// realClock 返回的时间带有单调时钟读数，startTime 与 now 相减使用的是单调时间，
+// 不受墙上时钟调整的影响；但伪造的时钟可能回拨到 startTime 之前，此时按 0 个间隔处理。
 func (tb *Bucket) currentTick(now time.Time) int64 {
-	return int64(now.Sub(tb.startTime) / tb.fillInterval) // 经过时间 / 时间间隔
+	elapsed := now.Sub(tb.startTime) // 经过时间
+	if elapsed < 0 {
+		return 0
+	}
+	return int64(elapsed / tb.fillInterval) // 经过时间 / 时间间隔
 }
 
 // adjustavailableTokens 调整当前令牌的数量
-//tick - tb.latestTick 必须 > 0，使得在给定的时间，使得令牌是可用的，
+//tick 小于 latestTick 时按 latestTick 处理，所以令牌数不会因为时钟回拨而减少
 func (tb *Bucket) adjustavailableTokens(tick int64) {
-	if tb.availableTokens >= tb.capacity { // 可用令牌数 >= 总量
+	if tb.backgroundRefill { // 令牌由后台 goroutine 填充
 		return
 	}
-	//当前令牌数 = 上一次剩余的令牌数 + 距离上次放置令牌的时间间隔数 * 每次放置的令牌数
-	tb.availableTokens += (tick - tb.latestTick) * tb.quantum
-	if tb.availableTokens > tb.capacity { //如果 剩余令牌数 > 总量 (满了溢出)，就要 令其相等
-		tb.availableTokens = tb.capacity
+	if tick < tb.latestTick {
+		// 伪造的时钟被回拨时 tick 可能比之前看到的还小，
+		// 此时按 latestTick 处理，不能补充负数个令牌，latestTick 也不能后退
+		tick = tb.latestTick
+	}
+	lastTick := tb.latestTick
+	tb.latestTick = tick                  //更新最新令牌数，桶满时也要更新，否则之后会把满着的这段时间也算进填充
+	if tb.availableTokens < tb.capacity { // 可用令牌数 < 总量
+		//当前令牌数 = 上一次剩余的令牌数 + 距离上次放置令牌的时间间隔数 * 每次放置的令牌数
+		//如果 剩余令牌数 > 总量 (满了溢出)，就要 令其相等
+		tb.journalClampRecord(tick, tb.availableTokens, tick-lastTick)
+		tb.availableTokens = tb.refillTokens(tb.availableTokens, tick-lastTick)
 	}
-	tb.latestTick = tick //更新最新令牌数
-	return
+	tb.rebase()
+}
+
+// rebaseSpan 是 startTime 到 latestTick 之间允许的最长时间，超过后把起点向后移动，见 rebase。
+const rebaseSpan = 10 * 365 * 24 * time.Hour
+
+// rebase 在 latestTick 距离 startTime 超过 rebaseSpan 时，把 startTime 移动到 latestTick 所在的间隔起点，
+// 并把 latestTick 归零。填充的边界和令牌数都不变，但 now.Sub(startTime) 和 tick 的乘法
+// 不会随着运行时间增长而溢出 int64 (time.Duration 最多约 292 年)。调用者需要持有 tb.mu。
+func (tb *Bucket) rebase() {
+	if tb.latestTick <= 0 || time.Duration(tb.latestTick)*tb.fillInterval < rebaseSpan {
+		return
+	}
+	tb.startTime = tb.startTime.Add(time.Duration(tb.latestTick) * tb.fillInterval)
+	tb.drainTick -= tb.latestTick
+	tb.latestTick = 0
+}
+
+// refillTokens 返回 avail 个令牌再经过 intervals 个填充间隔后的令牌数，
+// 结果不超过桶的容量。容量很大 (如 NewUnboundedBurstBucket) 时长时间空闲也不会溢出 int64。
+func (tb *Bucket) refillTokens(avail, intervals int64) int64 {
+	if intervals > math.MaxInt64/tb.quantum {
+		return tb.addTokens(avail, math.MaxInt64)
+	}
+	return tb.addTokens(avail, intervals*tb.quantum)
+}
+
+// addTokens 返回 avail 加上 n (>= 0) 个令牌后的令牌数，结果不超过桶的容量，也不会溢出 int64。
+func (tb *Bucket) addTokens(avail, n int64) int64 {
+	// avail 为负时 avail + n 不会溢出；avail 非负时 tb.capacity - avail 不会溢出
+	if avail >= 0 && n >= tb.capacity-avail {
+		return tb.capacity
+	}
+	avail += n
+	if avail > tb.capacity {
+		avail = tb.capacity
+	}
+	return avail
 }
 
 // Clock 以一种方式表示时间的流逝
@@ -330,10 +1112,32 @@ type Clock interface {
 	Sleep(d time.Duration)
 }
 
+// defaultClockValue 保存 SetDefaultClock 设置的时钟，类型总是 clockHolder。
+var defaultClockValue atomic.Value
+
+// clockHolder 使 atomic.Value 中保存的值的具体类型保持不变。
+type clockHolder struct{ clock Clock }
+
+// SetDefaultClock 设置没有指定时钟 (或指定为 nil) 时新建的桶使用的时钟，clock 为 nil 时恢复使用系统时钟。
+// 它用于测试在内部创建桶的代码，不必把时钟层层传递下去，应当在测试初始化时 (如 TestMain 中) 设置一次。
+// 它只影响之后新建的桶，不是为运行期间切换时钟设计的。
+func SetDefaultClock(clock Clock) {
+	defaultClockValue.Store(clockHolder{clock})
+}
+
+// defaultClock 返回 SetDefaultClock 设置的时钟，没有设置时返回系统时钟。
+func defaultClock() Clock {
+	if h, ok := defaultClockValue.Load().(clockHolder); ok && h.clock != nil {
+		return h.clock
+	}
+	return realClock{}
+}
+
 // realClock 意为真的时钟，实现时钟的标准时间函数。
 type realClock struct{}
 
 // Now 通过调用 time.Now 函数实现 Clock 接口.
+// time.Now 的结果带有单调时钟读数，桶内所有的时间差都基于它计算。
 func (realClock) Now() time.Time {
 	return time.Now()
 }
@@ -5,7 +5,15 @@
 package tokenBucket
 
 import (
+	"bytes"
+	"context"
+	"io/ioutil"
 	"math"
+	"math/rand"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -200,6 +208,27 @@ func (rateLimitSuite) TestTakeMaxDuration(c *gc.C) {
 	}
 }
 
+func (rateLimitSuite) TestTakeExactWait(c *gc.C) {
+	tb := NewBucketWithQuantum(100*time.Millisecond, 5, 5, WithExactWait())
+	d, ok := tb.take(tb.startTime, 5, infinityDuration)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(d, gc.Equals, time.Duration(0))
+
+	// 默认会等到下一次填充 (100ms)，精确模式只需要 1/5 个间隔。
+	d, ok = tb.take(tb.startTime, 1, infinityDuration)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(d, gc.Equals, 20*time.Millisecond)
+
+	d, ok = tb.take(tb.startTime.Add(10*time.Millisecond), 1, infinityDuration)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(d, gc.Equals, 30*time.Millisecond)
+
+	// 超过 maxWait 时不取走令牌。
+	d, ok = tb.take(tb.startTime.Add(10*time.Millisecond), 1, 49*time.Millisecond)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(d, gc.Equals, time.Duration(0))
+}
+
 type takeAvailableReq struct {
 	time   time.Duration
 	count  int64
@@ -297,6 +326,1399 @@ func (rateLimitSuite) TestTakeAvailable(c *gc.C) {
 	}
 }
 
+func (rateLimitSuite) TestTakeAvailableFloor(c *gc.C) {
+	tb := NewBucket(time.Second, 10)
+	c.Assert(tb.takeAvailableFloor(tb.startTime, 8, 3), gc.Equals, int64(7))
+	c.Assert(tb.takeAvailableFloor(tb.startTime, 1, 3), gc.Equals, int64(0))
+	// 保留的令牌仍然可以被普通的 TakeAvailable 取走。
+	c.Assert(tb.takeAvailable(tb.startTime, 5), gc.Equals, int64(3))
+	c.Assert(tb.takeAvailableFloor(tb.startTime.Add(5*time.Second), 10, 3), gc.Equals, int64(2))
+
+	// 负的 floor 按 0 处理，不会取走桶中没有的令牌
+	tb = NewBucket(time.Second, 10)
+	c.Assert(tb.takeAvailableFloor(tb.startTime, 20, -5), gc.Equals, int64(10))
+	d, ok := tb.take(tb.startTime, 2, infinityDuration)
+	c.Assert(d, gc.Equals, 2*time.Second)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(tb.takeAvailableFloor(tb.startTime, 5, -5), gc.Equals, int64(0))
+	c.Assert(tb.availableTokens, gc.Equals, int64(-2))
+}
+
+func (rateLimitSuite) TestAllowAt(c *gc.C) {
+	tb := NewBucket(time.Second, 3)
+	c.Assert(tb.AllowAt(tb.startTime, 3), gc.Equals, true)
+	c.Assert(tb.AllowAt(tb.startTime, 4), gc.Equals, false)
+	c.Assert(tb.takeAvailable(tb.startTime, 3), gc.Equals, int64(3))
+	c.Assert(tb.AllowAt(tb.startTime.Add(time.Second), 2), gc.Equals, false)
+	c.Assert(tb.AllowAt(tb.startTime.Add(2*time.Second), 2), gc.Equals, true)
+	c.Assert(tb.AllowAt(tb.startTime.Add(time.Hour), 3), gc.Equals, true)
+	// AllowAt 不会修改桶的状态。
+	c.Assert(tb.availableTokens, gc.Equals, int64(0))
+	c.Assert(tb.latestTick, gc.Equals, int64(0))
+}
+
+func (rateLimitSuite) TestAnd(c *gc.C) {
+	clock := &fakeClock{}
+	a := NewBucketWithClock(time.Second, 2, clock)
+	b := NewBucketWithClock(time.Second, 1, clock)
+	l := And(a, b)
+	c.Assert(l.Allow(), gc.Equals, true)
+	// b 拒绝时 a 被占用的令牌要归还。
+	c.Assert(l.Allow(), gc.Equals, false)
+	c.Assert(a.Available(), gc.Equals, int64(1))
+	c.Assert(b.Available(), gc.Equals, int64(0))
+	l.Refund()
+	c.Assert(a.Available(), gc.Equals, int64(2))
+	c.Assert(b.Available(), gc.Equals, int64(1))
+}
+
+func (rateLimitSuite) TestOr(c *gc.C) {
+	clock := &fakeClock{}
+	a := NewBucketWithClock(time.Second, 1, clock)
+	b := NewBucketWithClock(time.Second, 1, clock)
+	l := Or(a, b)
+	c.Assert(l.Allow(), gc.Equals, true)
+	c.Assert(l.Allow(), gc.Equals, true)
+	c.Assert(l.Allow(), gc.Equals, false)
+	l.Refund()
+	c.Assert(a.Available(), gc.Equals, int64(1))
+	c.Assert(b.Available(), gc.Equals, int64(0))
+}
+
+func (rateLimitSuite) TestDefaultCost(c *gc.C) {
+	tb := NewBucketWithClock(time.Second, 5, &fakeClock{}, WithDefaultCost(2))
+	c.Assert(tb.Allow(), gc.Equals, true)
+	c.Assert(tb.Allow(), gc.Equals, true)
+	c.Assert(tb.Allow(), gc.Equals, false)
+	c.Assert(tb.Available(), gc.Equals, int64(1))
+	tb.Refund()
+	c.Assert(tb.Available(), gc.Equals, int64(3))
+}
+
+func (rateLimitSuite) TestAsLimiter(c *gc.C) {
+	clock := &fakeClock{}
+	l := AsLimiter(NewBucketWithClock(time.Second, 2, clock))
+	c.Assert(l.Take(), gc.Equals, time.Time{})
+	c.Assert(l.Take(), gc.Equals, time.Time{})
+	c.Assert(l.Take(), gc.Equals, time.Time{}.Add(time.Second))
+	_, ok := l.AllowN(1)
+	c.Assert(ok, gc.Equals, false)
+	clock.advance(2 * time.Second)
+	now, ok := l.AllowN(2)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(now, gc.Equals, time.Time{}.Add(3*time.Second))
+}
+
+func (rateLimitSuite) TestAsLimiterTakeContext(c *gc.C) {
+	clock := newManualClock()
+	tb := NewBucketWithClock(time.Second, 1, clock)
+	l := AsLimiter(tb)
+	_, err := l.TakeContext(context.Background())
+	c.Assert(err, gc.IsNil)
+
+	// 令牌不足时等待，被取消后归还令牌
+	ctx, cancel := context.WithCancel(context.Background())
+	errc := make(chan error)
+	go func() {
+		_, err := l.TakeContext(ctx)
+		errc <- err
+	}()
+	for tb.Waiters() == 0 {
+		runtime.Gosched()
+	}
+	c.Assert(tb.Available(), gc.Equals, int64(-1))
+	cancel()
+	c.Assert(<-errc, gc.Equals, context.Canceled)
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+	clock.advance(time.Second)
+
+	_, err = l.TakeContext(ctx)
+	c.Assert(err, gc.Equals, context.Canceled)
+}
+
+func (rateLimitSuite) TestAsLimiterTryTake(c *gc.C) {
+	clock := &fakeClock{}
+	tb := NewBucketWithClock(time.Second, 1, clock)
+	l := AsLimiter(tb)
+	now, ok := l.TryTake()
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(now, gc.Equals, time.Time{})
+
+	// 默认只在无需等待时放行，拒绝时不取走令牌也不等待
+	_, ok = l.TryTake()
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+	c.Assert(clock.Now(), gc.Equals, time.Time{})
+
+	tb = NewBucketWithClock(time.Second, 1, clock, WithMaxWait(time.Second))
+	l = AsLimiter(tb)
+	tb.Take(1)
+	now, ok = l.TryTake()
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(now, gc.Equals, time.Time{}.Add(time.Second))
+
+	// 需要等待 2s，超过了上限
+	tb.Take(1)
+	_, ok = l.TryTake()
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(tb.Available(), gc.Equals, int64(-1))
+	c.Assert(clock.Now(), gc.Equals, time.Time{}.Add(time.Second))
+}
+
+func (rateLimitSuite) TestRetryAfter(c *gc.C) {
+	clock := &fakeClock{}
+	tb := NewBucketWithClock(time.Second, 2, clock)
+	c.Assert(tb.RetryAfter(2), gc.Equals, time.Duration(0))
+	c.Assert(tb.RetryAfter(3), gc.Equals, time.Second)
+	c.Assert(tb.TakeAvailable(2), gc.Equals, int64(2))
+	clock.advance(500 * time.Millisecond)
+	c.Assert(tb.RetryAfter(2), gc.Equals, 1500*time.Millisecond)
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+}
+
+func (rateLimitSuite) TestUtilization(c *gc.C) {
+	clock := &fakeClock{}
+	tb := NewBucketWithClock(time.Second, 4, clock)
+	c.Assert(tb.Utilization(), gc.Equals, 0.0)
+	tb.Take(3)
+	c.Assert(tb.Utilization(), gc.Equals, 0.75)
+	tb.Take(3)
+	c.Assert(tb.Utilization(), gc.Equals, 1.0)
+	clock.advance(4 * time.Second)
+	c.Assert(tb.Utilization(), gc.Equals, 0.5)
+}
+
+func (rateLimitSuite) TestDrainTo(c *gc.C) {
+	tb := NewBucketWithClock(time.Second, 10, &fakeClock{})
+	c.Assert(tb.DrainTo(4), gc.Equals, int64(6))
+	c.Assert(tb.Available(), gc.Equals, int64(4))
+	c.Assert(tb.DrainTo(4), gc.Equals, int64(0))
+	c.Assert(tb.DrainTo(6), gc.Equals, int64(0))
+	c.Assert(tb.Available(), gc.Equals, int64(4))
+}
+
+func (rateLimitSuite) TestAlignedFill(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(100, int64(700*time.Millisecond))}
+	tb := NewBucketWithClock(time.Second, 2, clock, WithAlignedFill())
+	c.Assert(tb.startTime.Equal(time.Unix(100, 0)), gc.Equals, true)
+	c.Assert(tb.TakeAvailable(2), gc.Equals, int64(2))
+	// 到下一个整秒只需要 300ms，而不是完整的一个间隔。
+	c.Assert(tb.Take(1), gc.Equals, 300*time.Millisecond)
+
+	tb = NewBucketWithRateAndClock(10, 1, clock, WithAlignedFill())
+	c.Assert(tb.startTime.Equal(time.Unix(100, int64(700*time.Millisecond))), gc.Equals, true)
+}
+
+func (rateLimitSuite) TestTakeErr(c *gc.C) {
+	clock := &fakeClock{}
+	tb := NewBucketWithClock(time.Second, 1, clock)
+	c.Assert(tb.TakeErr(1, 0), gc.IsNil)
+	err := tb.TakeErr(2, time.Second)
+	c.Assert(err, gc.ErrorMatches, "token bucket throttled, retry after 2s")
+	c.Assert(err.(*ThrottledError).RetryAfter(), gc.Equals, 2*time.Second)
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+
+	c.Assert(tb.TakeErr(1, time.Second), gc.IsNil)
+	c.Assert(clock.Now(), gc.Equals, time.Time{}.Add(time.Second))
+}
+
+// TakeErr 的 RetryAfter 与 AllowN 在同一时刻、同样的状态下返回的 retryAfter 相同。
+func (rateLimitSuite) TestTakeErrRetryAfterMatchesAllowN(c *gc.C) {
+	for _, opts := range [][]Option{nil, {WithExactWait()}} {
+		clock := &fakeClock{}
+		tb := NewBucketWithQuantumAndClock(time.Second, 4, 2, clock, opts...)
+		tb.Take(5)
+		for i := 0; i < 6; i++ {
+			ok, _, want := tb.AllowN(3)
+			c.Assert(ok, gc.Equals, false)
+			err := tb.TakeErr(3, 0)
+			c.Assert(err, gc.FitsTypeOf, &ThrottledError{})
+			c.Assert(err.(*ThrottledError).RetryAfter(), gc.Equals, want, gc.Commentf("opts %d, step %d", len(opts), i))
+			clock.advance(300 * time.Millisecond)
+		}
+	}
+}
+
+func (rateLimitSuite) TestUnboundedBurstBucket(c *gc.C) {
+	clock := &fakeClock{}
+	tb := NewUnboundedBurstBucketWithClock(time.Second, 3, clock)
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+	c.Assert(tb.Capacity(), gc.Equals, int64(math.MaxInt64))
+
+	// 令牌一直积累，不受容量限制
+	clock.advance(1000 * time.Second)
+	c.Assert(tb.Available(), gc.Equals, int64(3000))
+	c.Assert(tb.TakeAvailable(2500), gc.Equals, int64(2500))
+	c.Assert(tb.Available(), gc.Equals, int64(500))
+
+	// 长时间空闲后饱和在 math.MaxInt64，而不是溢出成负数
+	tb = NewUnboundedBurstBucketWithClock(time.Nanosecond, 1<<40, clock)
+	clock.advance(100 * 365 * 24 * time.Hour)
+	c.Assert(tb.Available(), gc.Equals, int64(math.MaxInt64))
+	c.Assert(tb.Take(1<<62), gc.Equals, time.Duration(0))
+	tb.Return(1 << 62)
+	c.Assert(tb.Available(), gc.Equals, int64(math.MaxInt64))
+}
+
+func (rateLimitSuite) TestMaxObservedBurst(c *gc.C) {
+	clock := &fakeClock{}
+	tb := NewBucketWithClock(time.Second, 10, clock, WithBurstTracking())
+	tb.Take(3)
+	tb.Take(6)
+	tb.Take(4) // 需要等待，不计入
+	c.Assert(tb.MaxObservedBurst(), gc.Equals, int64(6))
+	c.Assert(tb.MaxObservedBurst(), gc.Equals, int64(0))
+
+	clock.advance(10 * time.Second)
+	c.Assert(tb.TakeAvailable(20), gc.Equals, int64(7))
+	c.Assert(tb.MaxObservedBurst(), gc.Equals, int64(7))
+
+	tb = NewBucketWithClock(time.Second, 10, clock)
+	tb.Take(5)
+	c.Assert(tb.MaxObservedBurst(), gc.Equals, int64(0))
+}
+
+func (rateLimitSuite) TestTakeAt(c *gc.C) {
+	clock := &fakeClock{}
+	tb := NewBucketWithClock(time.Second, 10, clock)
+	tb.Take(10)
+	start := clock.Now()
+
+	d, ok := tb.TakeAt(start.Add(5*time.Second), 5)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(d, gc.Equals, 5*time.Second)
+	c.Assert(tb.Available(), gc.Equals, int64(-5))
+
+	// 5s 时的令牌已经被预订完
+	_, ok = tb.TakeAt(start.Add(5*time.Second), 1)
+	c.Assert(ok, gc.Equals, false)
+	d, ok = tb.TakeAt(start.Add(8*time.Second), 3)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(d, gc.Equals, 8*time.Second)
+
+	// 之后的请求排在预订之后
+	c.Assert(tb.Take(1), gc.Equals, 9*time.Second)
+
+	d, ok = tb.TakeAt(start.Add(-time.Second), 1)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(d, gc.Equals, time.Duration(0))
+
+	// 满桶上预订得太远时，桶在那之前就会补满，预订被拒绝，现在的令牌不受影响
+	tb = NewBucketWithClock(time.Second, 10, clock)
+	start = clock.Now()
+	_, ok = tb.TakeAt(start.Add(20*time.Second), 5)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(tb.Available(), gc.Equals, int64(10))
+	// 扣除 5 个之后桶在 5s 时正好补满，预订在 5s 时已经没有作用
+	_, ok = tb.TakeAt(start.Add(5*time.Second), 5)
+	c.Assert(ok, gc.Equals, false)
+	d, ok = tb.TakeAt(start.Add(4*time.Second), 5)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(d, gc.Equals, 4*time.Second)
+	c.Assert(tb.Available(), gc.Equals, int64(5))
+	_, ok = tb.TakeAt(start.Add(6*time.Second), 1)
+	c.Assert(ok, gc.Equals, false)
+}
+
+func (rateLimitSuite) TestMustBucket(c *gc.C) {
+	tb := MustBucket(-1, 0)
+	c.Assert(tb.Capacity(), gc.Equals, int64(1))
+	c.Assert(isCloseTo(tb.Rate(), 1, rateMargin), gc.Equals, true)
+
+	tb = MustBucket(math.NaN(), 5)
+	c.Assert(isCloseTo(tb.Rate(), 1, rateMargin), gc.Equals, true)
+	tb = MustBucket(1e-12, 5)
+	c.Assert(isCloseTo(tb.Rate(), minMustRate, rateMargin), gc.Equals, true)
+
+	tb = MustBucket(100, 10)
+	c.Assert(tb.Capacity(), gc.Equals, int64(10))
+	c.Assert(isCloseTo(tb.Rate(), 100, rateMargin), gc.Equals, true)
+
+	// 输出警告的 Logger panic 时，panic 交给 WithPanicHandler，仍然返回修正后的桶
+	var recovered []interface{}
+	tb = MustBucket(-1, 0,
+		WithLogger(func(level, msg string, fields map[string]interface{}) { panic(msg) }),
+		WithPanicHandler(func(v interface{}) { recovered = append(recovered, v) }))
+	c.Assert(tb.Capacity(), gc.Equals, int64(1))
+	c.Assert(recovered, gc.DeepEquals, []interface{}{
+		"MustBucket rate is not a positive number",
+		"MustBucket capacity is not > 0",
+	})
+}
+
+// closeRecorder 记录 Close 是否被调用。
+type closeRecorder struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (r *closeRecorder) Close() error {
+	r.closed = true
+	return nil
+}
+
+func (rateLimitSuite) TestReaderWriter(c *gc.C) {
+	clock := &fakeClock{}
+	tb := NewBucketWithClock(time.Millisecond, 100, clock)
+
+	src := &closeRecorder{}
+	src.WriteString(strings.Repeat("x", 300))
+	data, err := ioutil.ReadAll(NewReader(src, tb))
+	c.Assert(err, gc.IsNil)
+	c.Assert(len(data), gc.Equals, 300)
+	// 桶里原有 100 个令牌，另外 200 个字节需要 200ms
+	c.Assert(clock.Now(), gc.Equals, time.Time{}.Add(200*time.Millisecond))
+	c.Assert(NewReader(src, tb).Close(), gc.IsNil)
+	c.Assert(src.closed, gc.Equals, true)
+
+	dst := &closeRecorder{}
+	w := NewWriter(dst, tb)
+	n, err := w.Write(data)
+	c.Assert(err, gc.IsNil)
+	c.Assert(n, gc.Equals, 300)
+	c.Assert(dst.Len(), gc.Equals, 300)
+	c.Assert(clock.Now(), gc.Equals, time.Time{}.Add(500*time.Millisecond))
+	c.Assert(w.Close(), gc.IsNil)
+	// 底层没有实现 io.Closer 时 Close 什么也不做
+	c.Assert(NewWriter(ioutil.Discard, tb).Close(), gc.IsNil)
+	c.Assert(dst.closed, gc.Equals, true)
+}
+
+func (rateLimitSuite) TestSimulate(c *gc.C) {
+	tb := NewBucket(time.Second, 2)
+	start := time.Unix(1000, 0)
+	trace := []time.Time{
+		start,
+		start,
+		start,
+		start.Add(500 * time.Millisecond),
+		start.Add(5 * time.Second),
+	}
+	decisions := tb.Simulate(trace, 1)
+	c.Assert(decisions, gc.DeepEquals, []Decision{
+		{true, start, 0},
+		{true, start, 0},
+		{true, start.Add(time.Second), time.Second},
+		{true, start.Add(2 * time.Second), 1500 * time.Millisecond},
+		{true, start.Add(5 * time.Second), 0},
+	})
+	c.Assert(tb.Available(), gc.Equals, int64(2))
+
+	decisions = tb.SimulateMaxDuration(trace, 1, time.Second)
+	c.Assert(decisions[2], gc.Equals, Decision{true, start.Add(time.Second), time.Second})
+	c.Assert(decisions[3], gc.Equals, Decision{})
+
+	// 模拟从桶现在的令牌数开始：无上限突发的桶和 WithStartEmpty 的桶一开始是空的
+	trace = trace[:3]
+	tb = NewUnboundedBurstBucketWithClock(time.Second, 1, &fakeClock{})
+	c.Assert(tb.Simulate(trace, 1), gc.DeepEquals, []Decision{
+		{true, start.Add(time.Second), time.Second},
+		{true, start.Add(2 * time.Second), 2 * time.Second},
+		{true, start.Add(3 * time.Second), 3 * time.Second},
+	})
+	c.Assert(tb.SimulateMaxDuration(trace, 1, 0), gc.DeepEquals, make([]Decision, 3))
+
+	clock := &fakeClock{}
+	tb = NewBucketWithClock(time.Second, 2, clock, WithStartEmpty())
+	c.Assert(tb.Simulate(trace[:1], 1), gc.DeepEquals, []Decision{{true, start.Add(time.Second), time.Second}})
+	// 欠下的令牌也要先还上
+	clock.advance(time.Second)
+	c.Assert(tb.Take(3), gc.Equals, 2*time.Second)
+	c.Assert(tb.Simulate(trace[:1], 1), gc.DeepEquals, []Decision{{true, start.Add(3 * time.Second), 3 * time.Second}})
+}
+
+func (rateLimitSuite) TestName(c *gc.C) {
+	tb := NewBucket(time.Second, 1, WithName("uploads"))
+	c.Assert(tb.Name(), gc.Equals, "uploads")
+	c.Assert(AsLimiter(tb).Name(), gc.Equals, "uploads")
+	c.Assert(NewBucket(time.Second, 1).Name(), gc.Equals, "")
+}
+
+func (rateLimitSuite) TestDo(c *gc.C) {
+	clock := &fakeClock{}
+	tb := NewBucketWithClock(time.Second, 1, clock)
+	var ran []time.Time
+	fn := func() { ran = append(ran, clock.Now()) }
+	c.Assert(tb.Do(1, fn), gc.IsNil)
+	c.Assert(tb.Do(1, fn), gc.IsNil)
+	c.Assert(ran, gc.DeepEquals, []time.Time{{}, time.Time{}.Add(time.Second)})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Assert(tb.DoContext(ctx, 1, fn), gc.Equals, context.Canceled)
+	c.Assert(ran, gc.HasLen, 2)
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+}
+
+func (rateLimitSuite) TestDoContextDeadline(c *gc.C) {
+	clock := &fakeClock{}
+	tb := NewBucketWithClock(time.Second, 1, clock)
+	c.Assert(tb.TakeAvailable(1), gc.Equals, int64(1))
+	ran := false
+	fn := func() { ran = true }
+
+	// 令牌要 1s 后才可用，截止时间之前等不到
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	err := tb.DoContext(ctx, 1, fn)
+	c.Assert(err, gc.FitsTypeOf, &ThrottledError{})
+	c.Assert(err.(*ThrottledError).RetryAfter(), gc.Equals, time.Second)
+	c.Assert(ran, gc.Equals, false)
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	c.Assert(tb.DoContext(ctx, 1, fn), gc.IsNil)
+	c.Assert(ran, gc.Equals, true)
+	c.Assert(clock.Now(), gc.Equals, time.Time{}.Add(time.Second))
+}
+
+func (rateLimitSuite) TestLongUptime(c *gc.C) {
+	clock := &fakeClock{}
+	tb := NewBucketWithQuantumAndClock(time.Millisecond, 100, 3, clock)
+	year := 365 * 24 * time.Hour
+	// 总共推进 400 年，超出 time.Duration 能表示的约 292 年
+	for i := 0; i < 40; i++ {
+		clock.advance(10 * year)
+		c.Assert(tb.Available(), gc.Equals, int64(100))
+		c.Assert(tb.TakeAvailable(100), gc.Equals, int64(100))
+		c.Assert(tb.Take(3), gc.Equals, time.Millisecond)
+		// 桶满着的这段时间不能再算进填充
+		clock.advance(time.Millisecond)
+		c.Assert(tb.Available(), gc.Equals, int64(0))
+		clock.advance(time.Millisecond)
+		c.Assert(tb.Available(), gc.Equals, int64(3))
+		c.Assert(clock.Now().Sub(tb.startTime) <= rebaseSpan+10*year, gc.Equals, true)
+	}
+}
+
+// logEntry 是 Logger 收到的一条日志。
+type logEntry struct {
+	level, msg string
+	fields     map[string]interface{}
+}
+
+func (rateLimitSuite) TestLogger(c *gc.C) {
+	var entries []logEntry
+	logger := func(level, msg string, fields map[string]interface{}) {
+		entries = append(entries, logEntry{level, msg, fields})
+	}
+	clock := &fakeClock{}
+	tb := NewBucketWithClock(time.Second, 1, clock, WithLogger(logger), WithName("api"))
+	tb.Take(1)
+	c.Assert(entries, gc.HasLen, 0)
+	tb.Take(1)
+	_, ok := tb.TakeMaxDuration(1, 0)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(entries, gc.DeepEquals, []logEntry{
+		{LevelDebug, "token bucket waiting for tokens", map[string]interface{}{"name": "api", "count": int64(1), "wait": time.Second}},
+		{LevelDebug, "token bucket throttled", map[string]interface{}{"name": "api", "count": int64(1)}},
+	})
+
+	entries = nil
+	MustBucket(-1, 0, WithLogger(logger))
+	c.Assert(entries, gc.HasLen, 2)
+	c.Assert(entries[0].level, gc.Equals, LevelWarn)
+	c.Assert(entries[1].fields["capacity"], gc.Equals, int64(0))
+}
+
+func (rateLimitSuite) TestSetRate(c *gc.C) {
+	clock := &fakeClock{}
+	tb := NewBucketWithRateAndClock(10, 10, clock)
+	tb.Take(10)
+	clock.advance(500 * time.Millisecond)
+	tb.SetRate(100)
+	c.Assert(isCloseTo(tb.Rate(), 100, rateMargin), gc.Equals, true)
+	c.Assert(tb.Available(), gc.Equals, int64(5))
+	clock.advance(50 * time.Millisecond)
+	c.Assert(tb.Available(), gc.Equals, int64(10))
+	c.Assert(func() { tb.SetRate(0) }, gc.PanicMatches, "token bucket rate is not > 0")
+}
+
+func (rateLimitSuite) TestScheduledBucket(c *gc.C) {
+	clock := newManualClock()
+	clock.advance(8 * time.Hour)
+	sb := NewScheduledBucket(NewBucketWithClock(time.Second, 100, clock), []RateChange{
+		{TimeOfDay: 9 * time.Hour, Rate: 50},
+		{TimeOfDay: 18 * time.Hour, Rate: 5},
+	})
+	defer sb.Close()
+	waitRate := func(want float64) {
+		for i := 0; !isCloseTo(sb.Rate(), want, rateMargin); i++ {
+			c.Assert(i < 1000, gc.Equals, true, gc.Commentf("rate %v, want %v", sb.Rate(), want))
+			time.Sleep(time.Millisecond)
+		}
+	}
+	// 08:00 沿用前一天最后一项
+	waitRate(5)
+	for _, step := range []struct {
+		advance time.Duration
+		rate    float64
+	}{
+		{time.Hour, 50},
+		{9 * time.Hour, 5},
+		{15 * time.Hour, 50},
+	} {
+		clock.waitSleepers(1)
+		clock.advance(step.advance)
+		waitRate(step.rate)
+	}
+
+	// Close 立即停止 goroutine，不必等到日程中的下一个时刻
+	before := runtime.NumGoroutine()
+	NewScheduledBucket(NewBucket(time.Second, 100), []RateChange{{Rate: 1}}).Close()
+	waitGoroutines(c, before)
+}
+
+func (rateLimitSuite) TestTakeMany(c *gc.C) {
+	clock := &fakeClock{}
+	tb := NewBucketWithClock(time.Second, 5, clock)
+	c.Assert(tb.TakeMany(3), gc.Equals, 3)
+	c.Assert(tb.TakeMany(3), gc.Equals, 2)
+	c.Assert(tb.TakeMany(3), gc.Equals, 0)
+	c.Assert(tb.TakeMany(0), gc.Equals, 0)
+	clock.advance(time.Second)
+	c.Assert(tb.TakeMany(3), gc.Equals, 1)
+}
+
+func (rateLimitSuite) TestTakeAvailableDoesNotStealFromWait(c *gc.C) {
+	clock := newManualClock()
+	tb := NewBucketWithClock(time.Second, 5, clock)
+	tb.Take(5)
+
+	done := make(chan struct{})
+	go func() {
+		tb.Wait(3)
+		close(done)
+	}()
+	for tb.Waiters() == 0 {
+		runtime.Gosched()
+	}
+	// 等待者的 3 个令牌补回来之前，TakeAvailable 一个也取不到
+	for i := 0; i < 3; i++ {
+		c.Assert(tb.TakeAvailable(1), gc.Equals, int64(0))
+		clock.advance(time.Second)
+	}
+	<-done
+	clock.advance(time.Second)
+	c.Assert(tb.TakeAvailable(5), gc.Equals, int64(1))
+}
+
+func (rateLimitSuite) TestCompute(c *gc.C) {
+	tb := NewBucketWithClock(time.Second, 2, &fakeClock{})
+	start := tb.State().StartTime
+
+	s := tb.State()
+	var d time.Duration
+	var ok bool
+	for i, want := range []time.Duration{0, 0, time.Second, 2 * time.Second} {
+		s, d, ok = ComputeTake(s, start, 1, infinityDuration)
+		c.Assert(ok, gc.Equals, true, gc.Commentf("take %d", i))
+		c.Assert(d, gc.Equals, want, gc.Commentf("take %d", i))
+	}
+	_, _, ok = ComputeTake(s, start, 1, time.Second)
+	c.Assert(ok, gc.Equals, false)
+	// 纯函数不修改桶
+	c.Assert(tb.State().AvailableTokens, gc.Equals, int64(2))
+
+	for _, want := range []time.Duration{0, 0, time.Second} {
+		d, ok = tb.Compute(start, 1, infinityDuration)
+		c.Assert(ok, gc.Equals, true)
+		c.Assert(d, gc.Equals, want)
+	}
+	d, ok = tb.Compute(start.Add(3*time.Second), 2, 0)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(d, gc.Equals, time.Duration(0))
+}
+
+func (rateLimitSuite) TestPaced(c *gc.C) {
+	clock := &fakeClock{}
+	tb := NewBucketWithClock(time.Second, 5, clock)
+	l := Paced(tb, 100*time.Millisecond)
+
+	prev := l.Take()
+	c.Assert(prev, gc.Equals, time.Time{})
+	for i := 0; i < 8; i++ {
+		now := l.Take()
+		c.Assert(now.Sub(prev) >= 100*time.Millisecond, gc.Equals, true, gc.Commentf("take %d: gap %v", i, now.Sub(prev)))
+		prev = now
+	}
+	// 前 5 个按间隔放行，之后受令牌的限制
+	c.Assert(prev, gc.Equals, time.Time{}.Add(4*time.Second))
+
+	_, ok := l.AllowN(1)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(l.RetryAfter(1), gc.Equals, time.Second)
+}
+
+func (rateLimitSuite) TestPacedTryTake(c *gc.C) {
+	clock := &fakeClock{}
+	tb := NewBucketWithClock(time.Second, 5, clock, WithMaxWait(100*time.Millisecond))
+	l := Paced(tb, 200*time.Millisecond)
+	now, ok := l.TryTake()
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(now, gc.Equals, time.Time{})
+
+	// 令牌充足，但间隔还要等待 200ms，超过了上限
+	c.Assert(l.RetryAfter(1), gc.Equals, 200*time.Millisecond)
+	_, ok = l.TryTake()
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(tb.Available(), gc.Equals, int64(4))
+	c.Assert(clock.Now(), gc.Equals, time.Time{})
+
+	clock.advance(100 * time.Millisecond)
+	now, ok = l.TryTake()
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(now, gc.Equals, time.Time{}.Add(200*time.Millisecond))
+	c.Assert(tb.Available(), gc.Equals, int64(3))
+}
+
+func (rateLimitSuite) TestAllowN(c *gc.C) {
+	clock := &fakeClock{}
+	tb := NewBucketWithClock(time.Second, 5, clock)
+	ok, remaining, retryAfter := tb.AllowN(3)
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(remaining, gc.Equals, int64(2))
+	c.Assert(retryAfter, gc.Equals, time.Duration(0))
+
+	ok, remaining, retryAfter = tb.AllowN(4)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(remaining, gc.Equals, int64(2))
+	c.Assert(retryAfter, gc.Equals, 2*time.Second)
+
+	tb.Take(4)
+	ok, remaining, retryAfter = tb.AllowN(1)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(remaining, gc.Equals, int64(0))
+	c.Assert(retryAfter, gc.Equals, 3*time.Second)
+}
+
+func (rateLimitSuite) TestTargetRate(c *gc.C) {
+	tb := NewBucketWithRate(0.3, 10)
+	c.Assert(tb.TargetRate(), gc.Equals, 0.3)
+	c.Assert(tb.Rate() != 0.3, gc.Equals, true)
+	tb.SetRate(19.9)
+	c.Assert(tb.TargetRate(), gc.Equals, 19.9)
+	c.Assert(NewBucket(time.Second, 1).TargetRate(), gc.Equals, 1.0)
+}
+
+func (rateLimitSuite) TestShardedBucket(c *gc.C) {
+	sb := NewShardedBucket(4, 1, 10)
+	c.Assert(sb.shards[0].Capacity(), gc.Equals, int64(3))
+	c.Assert(sb.shards[3].Capacity(), gc.Equals, int64(2))
+	c.Assert(isCloseTo(sb.shards[0].Rate(), 0.25, rateMargin), gc.Equals, true)
+	c.Assert(sb.Available(), gc.Equals, int64(10))
+
+	// 选中的分片取空后借用其他分片的令牌
+	for i := 0; i < 10; i++ {
+		c.Assert(sb.Take(1), gc.Equals, time.Duration(0), gc.Commentf("take %d", i))
+	}
+	c.Assert(sb.Take(1) > 0, gc.Equals, true)
+	c.Assert(sb.TakeAvailable(5), gc.Equals, int64(0))
+
+	// Wait 在预订令牌的分片上等待，计入它的 Waiters，分片被 Shutdown 时返回并归还令牌
+	sb = NewShardedBucket(2, 1, 2)
+	sb.TakeAvailable(2)
+	done := make(chan struct{})
+	go func() {
+		sb.Wait(1)
+		close(done)
+	}()
+	for sb.shards[0].Waiters()+sb.shards[1].Waiters() == 0 {
+		runtime.Gosched()
+	}
+	for _, tb := range sb.shards {
+		tb.Shutdown()
+	}
+	<-done
+	c.Assert(sb.Available(), gc.Equals, int64(0))
+
+	c.Assert(func() { NewShardedBucket(0, 1, 10) }, gc.PanicMatches, "token bucket shards is not > 0")
+	c.Assert(func() { NewShardedBucket(4, 1, 3) }, gc.PanicMatches, "token bucket capacity is less than the number of shards")
+}
+
+func (rateLimitSuite) TestOptions(c *gc.C) {
+	type observation struct {
+		count int64
+		wait  time.Duration
+		ok    bool
+	}
+	var observed []observation
+	clock := &fakeClock{}
+	tb := NewBucket(time.Second, 10,
+		WithQuantum(2),
+		WithClock(clock),
+		WithInitialTokens(3),
+		WithObserver(func(count int64, wait time.Duration, ok bool) {
+			observed = append(observed, observation{count, wait, ok})
+		}),
+	)
+	c.Assert(tb.Available(), gc.Equals, int64(3))
+	c.Assert(tb.Take(5), gc.Equals, time.Second)
+	c.Assert(tb.TakeAvailable(3), gc.Equals, int64(0))
+	c.Assert(observed, gc.DeepEquals, []observation{{5, time.Second, true}, {3, 0, false}})
+
+	c.Assert(NewBucket(time.Second, 10, WithInitialTokens(20)).Available(), gc.Equals, int64(10))
+	c.Assert(func() { NewBucket(time.Second, 10, WithInitialTokens(-1)) }, gc.PanicMatches, "token bucket initial tokens is negative")
+	c.Assert(func() { NewBucket(time.Second, 10, WithQuantum(0)) }, gc.PanicMatches, "token bucket quantum is not > 0")
+}
+
+func (rateLimitSuite) TestWaitReturn(c *gc.C) {
+	clock := &fakeClock{}
+	tb := NewBucketWithClock(time.Second, 2, clock)
+	c.Assert(tb.WaitReturn(2), gc.Equals, time.Time{})
+	c.Assert(tb.WaitReturn(1), gc.Equals, time.Time{}.Add(time.Second))
+	c.Assert(tb.WaitReturn(2), gc.Equals, time.Time{}.Add(3*time.Second))
+	c.Assert(clock.Now(), gc.Equals, time.Time{}.Add(3*time.Second))
+}
+
+func (rateLimitSuite) TestJournalReplay(c *gc.C) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	var journal bytes.Buffer
+	tb := NewBucketWithClock(time.Second, 5, clock, WithJournal(&journal))
+	c.Assert(tb.TakeAvailable(4), gc.Equals, int64(4))
+	clock.advance(10 * time.Second) // 桶被填满，丢弃 9 个令牌
+	c.Assert(tb.Take(7), gc.Equals, 2*time.Second)
+	clock.advance(500 * time.Millisecond)
+	tb.Return(1)
+	tb.SetRate(4)
+	clock.advance(time.Second)
+	// 换速率时当前间隔已经过去的 500ms 按新的速率计入，一共补充 6 个令牌，从欠 1 个到被填满
+	c.Assert(tb.DrainTo(0), gc.Equals, int64(5))
+
+	c.Assert(strings.Count(journal.String(), "\n"), gc.Equals, 7)
+	c.Assert(strings.Contains(journal.String(), "C "), gc.Equals, true)
+
+	replayed, err := Replay(bytes.NewReader(journal.Bytes()))
+	c.Assert(err, gc.IsNil)
+	c.Assert(replayed.Available(), gc.Equals, tb.Available())
+	c.Assert(replayed.Rate(), gc.Equals, tb.Rate())
+	for _, d := range []time.Duration{100 * time.Millisecond, time.Second, time.Minute} {
+		now := clock.Now().Add(d)
+		c.Assert(replayed.available(now), gc.Equals, tb.available(now), gc.Commentf("%v", d))
+	}
+
+	_, err = Replay(strings.NewReader("T 1 1\n"))
+	c.Assert(err, gc.ErrorMatches, ".*line 1")
+	_, err = Replay(strings.NewReader("B 0 1000000000 5 1 5 0\nX 1 1\n"))
+	c.Assert(err, gc.ErrorMatches, ".*line 2")
+	_, err = Replay(strings.NewReader(""))
+	c.Assert(err, gc.ErrorMatches, ".*no start record")
+}
+
+func (rateLimitSuite) TestSetRateKeepsElapsedInterval(c *gc.C) {
+	clock := &fakeClock{}
+	tb := NewBucketWithRateAndClock(1, 1, clock)
+	c.Assert(tb.TakeAvailable(1), gc.Equals, int64(1))
+	// 比一个填充间隔更频繁地修改速率，令牌仍然按经过的时间补充
+	for i := 0; i < 5; i++ {
+		clock.advance(400 * time.Millisecond)
+		tb.SetRate(1 + float64(i%2))
+	}
+	c.Assert(tb.Available(), gc.Equals, int64(1))
+}
+
+func (rateLimitSuite) TestAdaptiveLimiter(c *gc.C) {
+	clock := &fakeClock{}
+	a := NewAdaptiveLimiter(NewBucketWithRateAndClock(100, 10, clock), 10, 200, 10)
+	c.Assert(a.AdaptiveRate(), gc.Equals, 100.0)
+
+	for i := 0; i < 5; i++ {
+		a.Report(true)
+	}
+	c.Assert(a.AdaptiveRate(), gc.Equals, 150.0)
+	c.Assert(a.TargetRate(), gc.Equals, 150.0)
+	for i := 0; i < 10; i++ {
+		a.Report(true)
+	}
+	c.Assert(a.AdaptiveRate(), gc.Equals, 200.0)
+
+	a.Report(false)
+	c.Assert(a.AdaptiveRate(), gc.Equals, 100.0)
+	c.Assert(a.TargetRate(), gc.Equals, 100.0)
+	for i := 0; i < 5; i++ {
+		a.Report(false)
+	}
+	c.Assert(a.AdaptiveRate(), gc.Equals, 10.0)
+	c.Assert(a.TargetRate(), gc.Equals, 10.0)
+
+	// 报告比填充间隔更频繁、速率不断变化时，令牌仍然会被补充
+	a = NewAdaptiveLimiter(NewBucketWithRateAndClock(1, 1, clock), 1, 4, 1)
+	c.Assert(a.TakeAvailable(1), gc.Equals, int64(1))
+	for i := 0; i < 20; i++ {
+		clock.advance(400 * time.Millisecond)
+		a.Report(i%2 == 0)
+	}
+	c.Assert(a.TakeAvailable(1), gc.Equals, int64(1))
+
+	// 初始速率限制在范围内
+	a = NewAdaptiveLimiter(NewBucketWithRateAndClock(1000, 10, clock), 10, 200, 10)
+	c.Assert(a.TargetRate(), gc.Equals, 200.0)
+
+	c.Assert(func() { NewAdaptiveLimiter(NewBucketWithClock(1, 1, clock), 0, 1, 1) }, gc.PanicMatches, "token bucket adaptive min rate is not > 0")
+	c.Assert(func() { NewAdaptiveLimiter(NewBucketWithClock(1, 1, clock), 2, 1, 1) }, gc.PanicMatches, "token bucket adaptive max rate is not >= min rate")
+	c.Assert(func() { NewAdaptiveLimiter(NewBucketWithClock(1, 1, clock), 1, 2, 0) }, gc.PanicMatches, "token bucket adaptive step is not > 0")
+}
+
+func (rateLimitSuite) TestTimeToFull(c *gc.C) {
+	clock := &fakeClock{}
+	tb := NewBucketWithQuantumAndClock(time.Second, 10, 3, clock)
+	c.Assert(tb.TimeToFull(), gc.Equals, time.Duration(0))
+
+	c.Assert(tb.TakeAvailable(7), gc.Equals, int64(7))
+	c.Assert(tb.TimeToFull(), gc.Equals, 3*time.Second)
+	clock.advance(1500 * time.Millisecond)
+	c.Assert(tb.Available(), gc.Equals, int64(6))
+	c.Assert(tb.TimeToFull(), gc.Equals, 1500*time.Millisecond)
+
+	// 有消费者在等待时，欠下的令牌也要补回来
+	tb.Take(16)
+	c.Assert(tb.TimeToFull(), gc.Equals, 6500*time.Millisecond)
+	clock.advance(time.Hour)
+	c.Assert(tb.TimeToFull(), gc.Equals, time.Duration(0))
+}
+
+func (rateLimitSuite) TestTakeAvailableAt(c *gc.C) {
+	start := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	tb := NewBucketWithClock(time.Second, 5, &fakeClock{now: start})
+	c.Assert(tb.TakeAvailableAt(start, 4), gc.Equals, int64(4))
+	c.Assert(tb.TakeAvailableAt(start.Add(2*time.Second), 5), gc.Equals, int64(3))
+	// 早于上一次的时刻不会补充令牌
+	c.Assert(tb.TakeAvailableAt(start.Add(time.Second), 1), gc.Equals, int64(0))
+	c.Assert(tb.TakeAvailableAt(start.Add(3*time.Second), 2), gc.Equals, int64(1))
+}
+
+func (rateLimitSuite) TestPanickingObserver(c *gc.C) {
+	clock := &fakeClock{}
+	var recovered []interface{}
+	tb := NewBucketWithClock(time.Second, 2, clock,
+		WithObserver(func(int64, time.Duration, bool) { panic("observer") }),
+		WithPanicHandler(func(v interface{}) { recovered = append(recovered, v) }))
+	c.Assert(tb.Take(1), gc.Equals, time.Duration(0))
+	c.Assert(tb.TakeAvailable(2), gc.Equals, int64(1))
+	c.Assert(tb.Take(1), gc.Equals, time.Second)
+	c.Assert(recovered, gc.DeepEquals, []interface{}{"observer", "observer", "observer"})
+
+	// 没有设置处理函数时 panic 被静默地 recover
+	tb = NewBucketWithClock(time.Second, 1, clock,
+		WithLogger(func(string, string, map[string]interface{}) { panic("logger") }))
+	c.Assert(tb.Take(1), gc.Equals, time.Duration(0))
+	c.Assert(tb.Take(1), gc.Equals, time.Second)
+}
+
+var newFromStringTests = []struct {
+	spec     string
+	rate     float64
+	capacity int64
+	err      string
+}{
+	{spec: "20/s burst=40", rate: 20, capacity: 40},
+	{spec: "20/s", rate: 20, capacity: 20},
+	{spec: "  120/m  ", rate: 2, capacity: 120},
+	{spec: "3600/h burst=1", rate: 1, capacity: 1},
+	{spec: "0.5/s", rate: 0.5, capacity: 1},
+	{spec: "", err: `.*want "<count>/<unit>".*`},
+	{spec: "20/s burst=40 extra", err: `.*want "<count>/<unit>".*`},
+	{spec: "20", err: ".*missing /<unit>"},
+	{spec: "x/s", err: ".*count is not a positive number"},
+	{spec: "0/s", err: ".*count is not a positive number"},
+	{spec: "-1/s", err: ".*count is not a positive number"},
+	{spec: "NaN/s", err: ".*count is not a positive number"},
+	{spec: "20/d", err: ".*unit is not s, m or h"},
+	{spec: "20/", err: ".*unit is not s, m or h"},
+	{spec: "1e-12/h", err: ".*rate is too small"},
+	{spec: "1e30/s", err: ".*rate is too large"},
+	{spec: "20/s cap=40", err: `.*unknown option "cap=40"`},
+	{spec: "20/s burst=0", err: ".*burst is not a positive integer"},
+	{spec: "20/s burst=1.5", err: ".*burst is not a positive integer"},
+}
+
+func (rateLimitSuite) TestNewFromString(c *gc.C) {
+	for _, test := range newFromStringTests {
+		tb, err := NewFromString(test.spec)
+		if test.err != "" {
+			c.Check(err, gc.ErrorMatches, test.err, gc.Commentf("%q", test.spec))
+			c.Check(tb, gc.IsNil)
+			continue
+		}
+		c.Assert(err, gc.IsNil, gc.Commentf("%q", test.spec))
+		c.Check(tb.TargetRate(), gc.Equals, test.rate, gc.Commentf("%q", test.spec))
+		c.Check(tb.Capacity(), gc.Equals, test.capacity, gc.Commentf("%q", test.spec))
+	}
+}
+
+func (rateLimitSuite) TestWaitNextQuantum(c *gc.C) {
+	clock := &fakeClock{}
+	tb := NewBucketWithQuantumAndClock(time.Second, 10, 2, clock)
+	tb.WaitNextQuantum()
+	c.Assert(clock.Now(), gc.Equals, time.Time{})
+
+	clock.advance(300 * time.Millisecond)
+	tb.WaitNextQuantum()
+	c.Assert(clock.Now(), gc.Equals, time.Time{}.Add(time.Second))
+	tb.WaitNextQuantum()
+	c.Assert(clock.Now(), gc.Equals, time.Time{}.Add(time.Second))
+
+	clock.advance(2500 * time.Millisecond)
+	tb.WaitNextQuantum()
+	c.Assert(clock.Now(), gc.Equals, time.Time{}.Add(4*time.Second))
+	c.Assert(tb.Available(), gc.Equals, int64(10))
+}
+
+func (rateLimitSuite) TestTakeWithDebt(c *gc.C) {
+	clock := &fakeClock{}
+	tb := NewBucketWithClock(time.Second, 5, clock)
+	c.Assert(tb.TakeWithDebt(7, 3), gc.Equals, true)
+	c.Assert(tb.Available(), gc.Equals, int64(-2))
+	c.Assert(tb.TakeWithDebt(2, 3), gc.Equals, false)
+	c.Assert(tb.TakeWithDebt(1, 3), gc.Equals, true)
+	c.Assert(tb.Available(), gc.Equals, int64(-3))
+
+	// 欠债随着填充还清
+	clock.advance(4 * time.Second)
+	c.Assert(tb.Available(), gc.Equals, int64(1))
+	c.Assert(tb.TakeWithDebt(2, -1), gc.Equals, false)
+	c.Assert(tb.TakeWithDebt(1, 0), gc.Equals, true)
+	c.Assert(tb.TakeWithDebt(0, 0), gc.Equals, true)
+}
+
+func (rateLimitSuite) TestAdmittedRate(c *gc.C) {
+	clock := &fakeClock{}
+	tb := NewBucketWithClock(time.Second, 100, clock, WithAdmittedRate(time.Minute))
+	c.Assert(tb.AdmittedRate(time.Minute), gc.Equals, 0.0)
+	c.Assert(tb.TakeAvailable(30), gc.Equals, int64(30))
+	clock.advance(10 * time.Second)
+	c.Assert(tb.TakeAvailable(10), gc.Equals, int64(10))
+	c.Assert(tb.AdmittedRate(time.Minute), gc.Equals, 4.0)
+	c.Assert(tb.AdmittedRate(time.Hour), gc.Equals, 4.0)
+	// 最近 5 个时间片从 6s 开始
+	c.Assert(tb.AdmittedRate(5*time.Second), gc.Equals, 2.5)
+
+	// 等待的请求在取走令牌时计入
+	clock.advance(500 * time.Millisecond)
+	tb.Take(100)
+	c.Assert(tb.AdmittedRate(time.Second), gc.Equals, 220.0)
+
+	clock.advance(2 * time.Minute)
+	c.Assert(tb.AdmittedRate(time.Minute), gc.Equals, 0.0)
+
+	tb = NewBucketWithClock(time.Second, 100, clock)
+	tb.Take(1)
+	c.Assert(tb.AdmittedRate(time.Minute), gc.Equals, 0.0)
+}
+
+func (rateLimitSuite) TestConcurrencyLimiter(c *gc.C) {
+	clock := &fakeClock{}
+	tb := NewBucketWithClock(time.Second, 3, clock)
+	cl := NewConcurrencyLimiter(tb, 2)
+
+	ctx := context.Background()
+	release1, err := cl.Acquire(ctx)
+	c.Assert(err, gc.IsNil)
+	release2, err := cl.Acquire(ctx)
+	c.Assert(err, gc.IsNil)
+	c.Assert(cl.InFlight(), gc.Equals, 2)
+
+	// 并发名额用完时等待，直到 ctx 被取消
+	timeout, cancel := context.WithTimeout(ctx, 10*time.Millisecond)
+	defer cancel()
+	_, err = cl.Acquire(timeout)
+	c.Assert(err, gc.Equals, context.DeadlineExceeded)
+	c.Assert(tb.Available(), gc.Equals, int64(1))
+
+	release1()
+	release1()
+	c.Assert(cl.InFlight(), gc.Equals, 1)
+	release3, err := cl.Acquire(ctx)
+	c.Assert(err, gc.IsNil)
+	release2()
+	release3()
+	c.Assert(cl.InFlight(), gc.Equals, 0)
+
+	// 令牌用完之后要等待令牌，已经取走的令牌不会因为 release 而归还
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+	release, err := cl.Acquire(ctx)
+	c.Assert(err, gc.IsNil)
+	c.Assert(clock.Now(), gc.Equals, time.Time{}.Add(time.Second))
+	release()
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+
+	c.Assert(func() { NewConcurrencyLimiter(tb, 0) }, gc.PanicMatches, "token bucket max concurrency is not > 0")
+}
+
+func (rateLimitSuite) TestSetDefaultClock(c *gc.C) {
+	clock := &fakeClock{}
+	SetDefaultClock(clock)
+	defer SetDefaultClock(nil)
+
+	tb := NewBucketWithRate(1, 1)
+	c.Assert(tb.clock, gc.Equals, Clock(clock))
+	c.Assert(tb.Take(2), gc.Equals, time.Second)
+	c.Assert(NewBucket(time.Second, 1).clock, gc.Equals, Clock(clock))
+
+	// 显式指定的时钟优先
+	other := &fakeClock{}
+	c.Assert(NewBucketWithClock(time.Second, 1, other).clock, gc.Equals, Clock(other))
+
+	SetDefaultClock(nil)
+	c.Assert(NewBucket(time.Second, 1).clock, gc.Equals, Clock(realClock{}))
+}
+
+func (rateLimitSuite) TestBatchCollector(c *gc.C) {
+	clock := newManualClock()
+	tb := NewBucketWithClock(time.Second, 1, clock)
+	bc := NewBatchCollector(tb, 10*time.Millisecond)
+
+	errs := make(chan error, 5)
+	for i := 0; i < 5; i++ {
+		go func() { errs <- bc.Acquire(context.Background()) }()
+	}
+	// 等待 5 个请求都加入批次，收集的 goroutine 在睡眠
+	for {
+		bc.mu.Lock()
+		var n int64
+		if bc.cur != nil {
+			n = bc.cur.n
+		}
+		bc.mu.Unlock()
+		if n == 5 {
+			break
+		}
+		runtime.Gosched()
+	}
+	clock.waitSleepers(1)
+	clock.advance(10 * time.Millisecond)
+
+	// 一次取走 5 个令牌，每个请求都要等待 4s
+	clock.waitSleepers(5)
+	c.Assert(tb.Available(), gc.Equals, int64(-4))
+	select {
+	case err := <-errs:
+		c.Fatalf("Acquire returned %v before the wait", err)
+	default:
+	}
+	clock.advance(4 * time.Second)
+	for i := 0; i < 5; i++ {
+		c.Assert(<-errs, gc.IsNil)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	c.Assert(bc.Acquire(ctx), gc.Equals, context.Canceled)
+}
+
+func (rateLimitSuite) TestTakeAvailableRateLimited(c *gc.C) {
+	clock := &fakeClock{}
+	tb := NewBucketWithQuantumAndClock(time.Second, 100, 10, clock)
+	c.Assert(tb.TakeAvailableRateLimited(100), gc.Equals, int64(10))
+	c.Assert(tb.TakeAvailableRateLimited(100), gc.Equals, int64(0))
+
+	clock.advance(3 * time.Second)
+	c.Assert(tb.TakeAvailableRateLimited(100), gc.Equals, int64(30))
+	c.Assert(tb.TakeAvailableRateLimited(100), gc.Equals, int64(0))
+
+	// 额度不累积
+	clock.advance(time.Second)
+	c.Assert(tb.TakeAvailableRateLimited(5), gc.Equals, int64(5))
+	c.Assert(tb.TakeAvailableRateLimited(5), gc.Equals, int64(0))
+
+	// 不超过桶中可用的令牌
+	c.Assert(tb.TakeAvailable(100), gc.Equals, int64(75))
+	clock.advance(2 * time.Second)
+	c.Assert(tb.TakeAvailableRateLimited(100), gc.Equals, int64(20))
+
+	// SetRate 之后重新开始计算
+	tb.SetRate(1)
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+	clock.advance(5 * time.Second)
+	c.Assert(tb.TakeAvailableRateLimited(100), gc.Equals, int64(5))
+}
+
+func (rateLimitSuite) TestStartEmptyAndFull(c *gc.C) {
+	clock := &fakeClock{}
+	tb := NewBucketWithClock(time.Second, 5, clock, WithStartEmpty())
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+	clock.advance(2 * time.Second)
+	c.Assert(tb.Available(), gc.Equals, int64(2))
+
+	tb = NewBucketWithRateAndClock(10, 5, clock, WithStartEmpty(), WithStartFull())
+	c.Assert(tb.Available(), gc.Equals, int64(5))
+	tb = NewUnboundedBurstBucketWithClock(time.Second, 1, clock)
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+}
+
+func (rateLimitSuite) TestShutdown(c *gc.C) {
+	clock := newManualClock()
+	tb := NewBucketWithClock(time.Second, 1, clock)
+	c.Assert(tb.TakeAvailable(1), gc.Equals, int64(1))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	errs := make(chan error, 1)
+	go func() { errs <- tb.WaitContext(ctx, 5) }()
+	waited := make(chan struct{})
+	go func() {
+		tb.Wait(5)
+		close(waited)
+	}()
+	clock.waitSleepers(2)
+	c.Assert(tb.IsShutdown(), gc.Equals, false)
+	tb.Shutdown()
+	c.Assert(tb.IsShutdown(), gc.Equals, true)
+	c.Assert(<-errs, gc.Equals, ErrShutdown)
+	// 伪造的时钟上没有 ctx 的 Wait 直接调用 Sleep，不会被 Shutdown 唤醒，睡到令牌可用为止
+	clock.advance(10 * time.Second)
+	<-waited
+
+	// 之后的等待立即返回，不取走令牌
+	avail := tb.Available()
+	c.Assert(tb.WaitContext(context.Background(), 1), gc.Equals, ErrShutdown)
+	c.Assert(tb.DoContext(context.Background(), 1, func() { c.Fatalf("fn called after Shutdown") }), gc.Equals, ErrShutdown)
+	c.Assert(tb.Do(1, func() { c.Fatalf("fn called after Shutdown") }), gc.Equals, ErrShutdown)
+	c.Assert(tb.TakeErr(1, time.Hour), gc.Equals, ErrShutdown)
+	tb.Wait(100)
+	tb.WaitTotal(100, 10)
+	tb.WaitSpin(100)
+	c.Assert(tb.WaitReturn(100).IsZero(), gc.Equals, true)
+	c.Assert(tb.WaitMaxDuration(1, time.Hour), gc.Equals, false)
+	c.Assert(tb.Available(), gc.Equals, avail)
+	tb.Shutdown()
+
+	// 使用系统时钟时 Shutdown 唤醒正在等待的 Wait 和 WaitMaxDuration，它们归还取走的令牌
+	tb = NewBucket(time.Hour, 1)
+	c.Assert(tb.TakeAvailable(1), gc.Equals, int64(1))
+	oks := make(chan bool, 1)
+	go func() { oks <- tb.WaitMaxDuration(1, 2*time.Hour) }()
+	waited = make(chan struct{})
+	go func() {
+		tb.Wait(1)
+		close(waited)
+	}()
+	for tb.Waiters() < 2 {
+		runtime.Gosched()
+	}
+	tb.Shutdown()
+	c.Assert(<-oks, gc.Equals, false)
+	<-waited
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+}
+
+func (rateLimitSuite) TestInvariantsRandomOperations(c *gc.C) {
+	rnd := rand.New(rand.NewSource(1))
+	for run := 0; run < 20; run++ {
+		clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+		opts := []Option{WithInvariantChecks()}
+		if run%2 == 1 {
+			opts = append(opts, WithAlignedFill())
+		}
+		tb := NewBucketWithQuantumAndClock(time.Duration(1+rnd.Intn(1000))*time.Millisecond,
+			1+rnd.Int63n(100), 1+rnd.Int63n(10), clock, opts...)
+		for i := 0; i < 2000; i++ {
+			n := rnd.Int63n(50)
+			switch rnd.Intn(9) {
+			case 0:
+				tb.Take(n)
+			case 1:
+				tb.TakeAvailable(n)
+			case 2:
+				tb.Return(n)
+			case 3:
+				tb.SetRate(0.1 + rnd.Float64()*1000)
+			case 4:
+				tb.TakeWithDebt(n, rnd.Int63n(50))
+			case 5:
+				tb.TakeAvailableRateLimited(n)
+			case 6:
+				tb.TakeMaxDuration(n, time.Duration(rnd.Int63n(int64(time.Second))))
+			case 7:
+				// 偶尔把时钟向后拨或者推进很多年
+				switch rnd.Intn(20) {
+				case 0:
+					clock.advance(-time.Duration(rnd.Int63n(int64(time.Minute))))
+				case 1:
+					clock.advance(time.Duration(rnd.Int63n(int64(20 * 365 * 24 * time.Hour))))
+				}
+			default:
+				clock.advance(time.Duration(rnd.Int63n(int64(2 * time.Second))))
+			}
+			if err := tb.CheckInvariants(); err != nil {
+				c.Fatalf("run %d, step %d: %v", run, i, err)
+			}
+		}
+	}
+
+	tb := NewBucketWithClock(time.Second, 5, &fakeClock{}, WithInvariantChecks())
+	tb.availableTokens = 6
+	c.Assert(tb.CheckInvariants(), gc.ErrorMatches, "token bucket invariant violated: available tokens 6 exceed capacity 5")
+
+	// 没有开启时不检查，普通的桶也不记录检查的状态
+	tb = NewBucketWithClock(time.Second, 5, &fakeClock{})
+	c.Assert(tb.CheckInvariants(), gc.Equals, ErrInvariantChecksDisabled)
+}
+
+func (rateLimitSuite) TestLimiterPlan(c *gc.C) {
+	clock := &fakeClock{}
+	l := AsLimiter(NewBucketWithClock(time.Second, 2, clock))
+	c.Assert(l.Plan(0), gc.IsNil)
+	plan := l.Plan(4)
+	c.Assert(plan, gc.DeepEquals, []time.Time{{}, {}, time.Time{}.Add(time.Second), time.Time{}.Add(2 * time.Second)})
+	for _, want := range plan {
+		c.Assert(l.Take(), gc.Equals, want)
+	}
+
+	clock = &fakeClock{}
+	p := Paced(NewBucketWithClock(time.Second, 2, clock), 300*time.Millisecond)
+	plan = p.Plan(4)
+	c.Assert(plan, gc.DeepEquals, []time.Time{{}, time.Time{}.Add(300 * time.Millisecond), time.Time{}.Add(time.Second), time.Time{}.Add(2 * time.Second)})
+	for _, want := range plan {
+		c.Assert(p.Take(), gc.Equals, want)
+	}
+}
+
+func (rateLimitSuite) TestMaxWaitFromContext(c *gc.C) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	c.Assert(MaxWaitFromContext(context.Background(), clock), gc.Equals, infinityDuration)
+
+	ctx, cancel := context.WithDeadline(context.Background(), clock.Now().Add(3*time.Second))
+	defer cancel()
+	c.Assert(MaxWaitFromContext(ctx, clock), gc.Equals, 3*time.Second)
+	clock.advance(5 * time.Second)
+	c.Assert(MaxWaitFromContext(ctx, clock), gc.Equals, time.Duration(0))
+
+	ctx, cancel = context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	d := MaxWaitFromContext(ctx, nil)
+	c.Assert(d > 59*time.Minute && d <= time.Hour, gc.Equals, true)
+}
+
+func (rateLimitSuite) TestDimensions(c *gc.C) {
+	clock := &fakeClock{}
+	d := NewDimensions().
+		Add("requests", 10, 2, WithClock(clock)).
+		Add("bytes", 1000, 1000, WithClock(clock)).
+		Build()
+	c.Assert(d.Names(), gc.DeepEquals, []string{"bytes", "requests"})
+
+	ok, wait := d.Allow(map[string]int64{"requests": 1, "bytes": 600})
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(wait, gc.Equals, time.Duration(0))
+
+	// bytes 不足时 requests 的令牌也不会被取走
+	ok, wait = d.Allow(map[string]int64{"requests": 1, "bytes": 600})
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(wait, gc.Equals, 200*time.Millisecond)
+	c.Assert(d.Bucket("requests").Available(), gc.Equals, int64(1))
+	c.Assert(d.Bucket("bytes").Available(), gc.Equals, int64(400))
+
+	// 等待时间取所有维度中最长的
+	ok, wait = d.Allow(map[string]int64{"requests": 2, "bytes": 500})
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(wait, gc.Equals, 100*time.Millisecond)
+	c.Assert(d.Bucket("bytes").Available(), gc.Equals, int64(400))
+
+	ok, _ = d.Allow(map[string]int64{"requests": 1, "bytes": 0})
+	c.Assert(ok, gc.Equals, true)
+	c.Assert(d.Bucket("bytes").Available(), gc.Equals, int64(400))
+
+	c.Assert(func() { d.Allow(map[string]int64{"cpu": 1}) }, gc.PanicMatches, `token bucket dimension "cpu" is not registered`)
+	c.Assert(func() { NewDimensions().Add("a", 1, 1).Add("a", 1, 1) }, gc.PanicMatches, `token bucket dimension "a" is already registered`)
+}
+
+func (rateLimitSuite) TestRunAdmissionTest(c *gc.C) {
+	clock := &fakeClock{}
+	tb := NewBucketWithClock(time.Millisecond, 100, clock)
+	c.Assert(RunAdmissionTest(tb, 8, 50), gc.Equals, int64(100))
+
+	// 推进 30ms 补充 30 个令牌，不会多放行
+	clock.advance(30 * time.Millisecond)
+	c.Assert(RunAdmissionTest(tb, 8, 50), gc.Equals, int64(30))
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+}
+
+func (rateLimitSuite) TestSetClock(c *gc.C) {
+	old := &fakeClock{now: time.Unix(1e9, 0)}
+	tb := NewBucketWithClock(time.Second, 10, old, WithInvariantChecks())
+	c.Assert(tb.TakeAvailable(8), gc.Equals, int64(8))
+	old.advance(1500 * time.Millisecond)
+
+	mock := &fakeClock{}
+	tb.SetClock(mock)
+	c.Assert(tb.Available(), gc.Equals, int64(3))
+	// 当前间隔已经过去了 500ms，在新的时钟上再过 500ms 补充下一个令牌
+	mock.advance(499 * time.Millisecond)
+	c.Assert(tb.Available(), gc.Equals, int64(3))
+	mock.advance(time.Millisecond)
+	c.Assert(tb.Available(), gc.Equals, int64(4))
+
+	// 旧的时钟不再起作用
+	old.advance(time.Hour)
+	c.Assert(tb.Available(), gc.Equals, int64(4))
+	c.Assert(tb.CheckInvariants(), gc.IsNil)
+}
+
+func (rateLimitSuite) TestSetClockConcurrent(c *gc.C) {
+	clocks := []*fakeClock{{}, {}}
+	tb := NewBucketWithClock(time.Millisecond, 10, clocks[0])
+	l := AsLimiter(tb)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// 在 -race 下运行时，SetClock 与不持有锁读取时钟的代码同时运行不能报告数据竞争
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				switch i {
+				case 0:
+					c.Check(tb.WaitContext(context.Background(), 1), gc.IsNil)
+				case 1:
+					l.Take()
+				default:
+					_, err := l.TakeContext(ctx)
+					c.Check(err, gc.IsNil)
+				}
+			}
+		}(i)
+	}
+	for i := 0; i < 200; i++ {
+		tb.SetClock(clocks[i%2])
+		// 两个时钟都向前走，睡在旧时钟上的调用者也能醒来
+		clocks[0].advance(time.Millisecond)
+		clocks[1].advance(time.Millisecond)
+		runtime.Gosched()
+	}
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	for {
+		select {
+		case <-done:
+			return
+		default:
+			clocks[0].advance(time.Second)
+			clocks[1].advance(time.Second)
+			time.Sleep(time.Millisecond)
+		}
+	}
+}
+
+func (rateLimitSuite) TestMaxBurstDuration(c *gc.C) {
+	c.Assert(NewBucket(time.Second, 10).MaxBurstDuration(), gc.Equals, 10*time.Second)
+	c.Assert(NewBucketWithQuantum(time.Second, 10, 3).MaxBurstDuration(), gc.Equals, 4*time.Second)
+	c.Assert(NewUnboundedBurstBucket(time.Second, 1).MaxBurstDuration(), gc.Equals, infinityDuration)
+
+	// 与当前的令牌数无关，SetRate 之后按新的速率计算
+	tb := NewBucketWithRate(100, 50)
+	tb.TakeAvailable(20)
+	c.Assert(tb.MaxBurstDuration(), gc.Equals, 500*time.Millisecond)
+	tb.SetRate(10)
+	c.Assert(tb.MaxBurstDuration(), gc.Equals, 5*time.Second)
+}
+
 func (rateLimitSuite) TestPanics(c *gc.C) {
 	c.Assert(func() { NewBucket(0, 1) }, gc.PanicMatches, "token bucket fill interval is not > 0")
 	c.Assert(func() { NewBucket(-2, 1) }, gc.PanicMatches, "token bucket fill interval is not > 0")
@@ -323,6 +1745,422 @@ func (rateLimitSuite) TestRate(c *gc.C) {
 	}
 }
 
+func (rateLimitSuite) TestConcurrentAccessors(c *gc.C) {
+	// 配合 go test -race 运行，检查访问器与 Take 之间没有数据竞争。
+	tb := NewBucketWithRate(1e6, 100)
+	want := tb.Rate()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				tb.Take(1)
+				if r := tb.Rate(); r != want {
+					c.Errorf("got rate %v want %v", r, want)
+					return
+				}
+				if n := tb.Capacity(); n != 100 {
+					c.Errorf("got capacity %v want 100", n)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// fakeClock 是一个只能手动调整的时钟，Sleep 直接把时间向前推进。
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Sleep(d time.Duration) {
+	c.advance(d)
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func (rateLimitSuite) TestClockJumpBackward(c *gc.C) {
+	clock := &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+	tb := NewBucketWithClock(time.Second, 10, clock)
+	c.Assert(tb.TakeAvailable(10), gc.Equals, int64(10))
+
+	// 墙上时钟回拨一小时，间隔数不能变成负数，也不能补充令牌。
+	clock.advance(-time.Hour)
+	c.Assert(tb.currentTick(clock.Now()), gc.Equals, int64(0))
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+
+	// 时间重新越过 startTime 后正常补充。
+	clock.advance(time.Hour + 3*time.Second)
+	c.Assert(tb.currentTick(clock.Now()), gc.Equals, int64(3))
+	c.Assert(tb.Available(), gc.Equals, int64(3))
+}
+
+type countingMetrics struct {
+	allowed   int64
+	throttled int64
+	waited    time.Duration
+}
+
+func (m *countingMetrics) Allowed(n int64)              { m.allowed += n }
+func (m *countingMetrics) Throttled(n int64)            { m.throttled += n }
+func (m *countingMetrics) WaitObserved(d time.Duration) { m.waited += d }
+
+func (rateLimitSuite) TestClockJumpBackwardAfterTicks(c *gc.C) {
+	clock := &fakeClock{now: time.Unix(0, 0)}
+	tb := NewBucketWithClock(time.Second, 10, clock)
+	clock.advance(5 * time.Second)
+	c.Assert(tb.TakeAvailable(10), gc.Equals, int64(10))
+	tb.Return(4)
+
+	// 回拨到第 2 个间隔，令牌数不能减少
+	clock.advance(-3 * time.Second)
+	c.Assert(tb.Available(), gc.Equals, int64(4))
+	c.Assert(tb.latestTick, gc.Equals, int64(5))
+	c.Assert(tb.TakeAvailable(1), gc.Equals, int64(1))
+
+	// 回到第 5 个间隔之前都不补充，之后按第 5 个间隔起算
+	clock.advance(3 * time.Second)
+	c.Assert(tb.Available(), gc.Equals, int64(3))
+	clock.advance(2 * time.Second)
+	c.Assert(tb.Available(), gc.Equals, int64(5))
+}
+
+func (rateLimitSuite) TestMetrics(c *gc.C) {
+	m := &countingMetrics{}
+	clock := &fakeClock{}
+	tb := NewBucketWithClock(time.Second, 2, clock, WithMetrics(m))
+	c.Assert(tb.TakeAvailable(3), gc.Equals, int64(2))
+	c.Assert(tb.Take(1), gc.Equals, time.Second)
+	_, ok := tb.TakeMaxDuration(1, time.Second)
+	c.Assert(ok, gc.Equals, false)
+	c.Assert(*m, gc.Equals, countingMetrics{allowed: 3, throttled: 2, waited: time.Second})
+}
+
+func (rateLimitSuite) TestWaitTotal(c *gc.C) {
+	clock := &fakeClock{}
+	tb := NewBucketWithClock(time.Second, 2, clock)
+	tb.WaitTotal(5, 2)
+	c.Assert(clock.Now().Sub(time.Time{}), gc.Equals, 3*time.Second)
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+}
+
+// manualClock 的 Sleep 会阻塞，直到 advance 把时间推进到睡眠结束的时刻。
+type manualClock struct {
+	mu       sync.Mutex
+	cond     *sync.Cond
+	now      time.Time
+	sleepers int
+}
+
+func newManualClock() *manualClock {
+	c := &manualClock{}
+	c.cond = sync.NewCond(&c.mu)
+	return c
+}
+
+func (c *manualClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *manualClock) Sleep(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	end := c.now.Add(d)
+	c.sleepers++
+	for c.now.Before(end) {
+		c.cond.Wait()
+	}
+	c.sleepers--
+}
+
+// waitSleepers 等待直到有 n 个 goroutine 在 Sleep 中。
+func (c *manualClock) waitSleepers(n int) {
+	for {
+		c.mu.Lock()
+		m := c.sleepers
+		c.mu.Unlock()
+		if m >= n {
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+func (c *manualClock) advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	c.cond.Broadcast()
+}
+
+// waitAvailable 等待后台 goroutine 把可用令牌填充到 want 个。
+func waitAvailable(c *gc.C, tb *Bucket, want int64) {
+	for i := 0; i < 1000 && tb.Available() != want; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(tb.Available(), gc.Equals, want)
+}
+
+func (rateLimitSuite) TestBackgroundRefill(c *gc.C) {
+	clock := newManualClock()
+	tb := NewBucketWithQuantumAndClock(time.Second, 4, 2, clock, WithBackgroundRefill())
+	c.Assert(tb.TakeAvailable(4), gc.Equals, int64(4))
+
+	// 时钟每越过一个间隔的边界，后台 goroutine 就放入 quantum 个令牌。
+	clock.advance(time.Second)
+	waitAvailable(c, tb, 2)
+	clock.advance(2 * time.Second)
+	waitAvailable(c, tb, 4)
+
+	c.Assert(tb.TakeAvailable(4), gc.Equals, int64(4))
+	c.Assert(tb.Close(), gc.IsNil)
+	c.Assert(tb.Close(), gc.IsNil)
+	clock.advance(time.Second)
+	time.Sleep(10 * time.Millisecond)
+	c.Assert(tb.Available(), gc.Equals, int64(0))
+
+	// 填充间隔很长时 Close 也立即停止 goroutine，不必等到下一个边界
+	before := runtime.NumGoroutine()
+	tb = NewBucket(time.Hour, 1, WithBackgroundRefill())
+	tb.Close()
+	waitGoroutines(c, before)
+}
+
+// waitGoroutines 等待直到 goroutine 的数量不超过 n。
+func waitGoroutines(c *gc.C, n int) {
+	for i := 0; i < 1000 && runtime.NumGoroutine() > n; i++ {
+		time.Sleep(time.Millisecond)
+	}
+	c.Assert(runtime.NumGoroutine() <= n, gc.Equals, true)
+}
+
+func (rateLimitSuite) TestFairLimiter(c *gc.C) {
+	clock := newManualClock()
+	tb := NewBucketWithClock(time.Second, 1, clock)
+	c.Assert(tb.TakeAvailable(1), gc.Equals, int64(1))
+	f := NewFairLimiter(tb, map[string]float64{"a": 1, "b": 1})
+
+	var (
+		mu    sync.Mutex
+		order []string
+	)
+	done := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(order)
+	}
+	queued := func() int {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.waiting.Len()
+	}
+	wait := func(cond func() bool) {
+		for i := 0; i < 1000 && !cond(); i++ {
+			time.Sleep(time.Millisecond)
+		}
+		c.Assert(cond(), gc.Equals, true)
+	}
+	start := func(key string) {
+		go func() {
+			f.Wait(key, 1)
+			mu.Lock()
+			order = append(order, key)
+			mu.Unlock()
+		}()
+	}
+
+	// 第一个请求被取出后阻塞在桶上，其余的请求按顺序进入等待队列。
+	start("a")
+	wait(func() bool {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return f.vtime == 1
+	})
+	for i, key := range []string{"a", "a", "a", "a", "b", "b"} {
+		start(key)
+		n := i + 1
+		wait(func() bool { return queued() == n })
+	}
+	keys := func() int {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		return len(f.finish)
+	}
+	c.Assert(keys(), gc.Equals, 2)
+	for i := 1; i <= 7; i++ {
+		clock.advance(time.Second)
+		n := i
+		wait(func() bool { return done() == n })
+	}
+	// b 的请求不会排在 a 积压的所有请求之后。
+	c.Assert(order, gc.DeepEquals, []string{"a", "a", "b", "a", "b", "a", "a"})
+
+	// 请求都被放行之后不再保留任何 key 的记录，大量只出现一次的 key 不会让 map 一直增长
+	c.Assert(keys(), gc.Equals, 0)
+	f = NewFairLimiter(NewBucketWithClock(time.Second, 100, &fakeClock{}), nil)
+	for i := 0; i < 100; i++ {
+		f.Wait(strconv.Itoa(i), 1)
+	}
+	wait(func() bool { return keys() == 0 })
+}
+
+func (rateLimitSuite) TestTakePriority(c *gc.C) {
+	clock := newManualClock()
+	tb := NewBucketWithClock(time.Second, 1, clock)
+	tb.TakePriority(1, 0)
+
+	// 令牌不足，并且等待令牌的时间超过 maxWait。
+	c.Assert(tb.TakePriorityMaxDuration(1, 0, 500*time.Millisecond), gc.Equals, false)
+
+	var (
+		mu    sync.Mutex
+		order []int
+	)
+	done := func() int {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(order)
+	}
+	queued := func() int {
+		tb.prioMu.Lock()
+		defer tb.prioMu.Unlock()
+		return tb.prioWaiting.Len()
+	}
+	wait := func(cond func() bool) {
+		for i := 0; i < 1000 && !cond(); i++ {
+			time.Sleep(time.Millisecond)
+		}
+		c.Assert(cond(), gc.Equals, true)
+	}
+	start := func(prio int) {
+		go func() {
+			tb.TakePriority(1, prio)
+			mu.Lock()
+			order = append(order, prio)
+			mu.Unlock()
+		}()
+	}
+
+	// 第一个请求被取出后阻塞在桶上，之后到达的高优先级请求排在低优先级请求之前。
+	start(1)
+	wait(func() bool { return tb.Waiters() == 1 })
+	start(0)
+	wait(func() bool { return queued() == 1 })
+	start(5)
+	wait(func() bool { return queued() == 2 })
+	for i := 1; i <= 3; i++ {
+		clock.advance(time.Second)
+		n := i
+		wait(func() bool { return done() == n })
+	}
+	c.Assert(order, gc.DeepEquals, []int{1, 5, 0})
+}
+
+// tickingClock 每次调用 Now 都前进 1µs，并记录 Sleep 的次数。
+type tickingClock struct {
+	now    time.Time
+	sleeps int
+}
+
+func (c *tickingClock) Now() time.Time {
+	c.now = c.now.Add(time.Microsecond)
+	return c.now
+}
+
+func (c *tickingClock) Sleep(d time.Duration) {
+	c.sleeps++
+	c.now = c.now.Add(d)
+}
+
+func (rateLimitSuite) TestWaitSpin(c *gc.C) {
+	clock := &tickingClock{}
+	tb := NewBucketWithClock(20*time.Microsecond, 1, clock)
+	tb.WaitSpin(1)
+	start := clock.now
+	tb.WaitSpin(1)
+	c.Assert(clock.sleeps, gc.Equals, 0)
+	c.Assert(clock.now.Sub(start) >= 10*time.Microsecond, gc.Equals, true)
+
+	tb = NewBucketWithClock(20*time.Microsecond, 1, clock, WithSpinThreshold(5*time.Microsecond))
+	tb.WaitSpin(1)
+	tb.WaitSpin(1)
+	c.Assert(clock.sleeps, gc.Equals, 1)
+}
+
+func (rateLimitSuite) TestLatencyHistogram(c *gc.C) {
+	c.Assert(NewBucket(time.Second, 1).LatencyHistogram(false), gc.IsNil)
+
+	tb := NewBucketWithClock(time.Second, 1, &fakeClock{}, WithLatencyHistogram(time.Second, 2*time.Second))
+	tb.Take(1)
+	tb.Take(1)
+	tb.Take(1)
+	tb.Take(1)
+	want := []HistogramBucket{
+		{UpperBound: time.Second, Count: 2},
+		{UpperBound: 2 * time.Second, Count: 1},
+		{UpperBound: infinityDuration, Count: 1},
+	}
+	c.Assert(tb.LatencyHistogram(true), gc.DeepEquals, want)
+	for _, b := range tb.LatencyHistogram(false) {
+		c.Assert(b.Count, gc.Equals, int64(0))
+	}
+}
+
+// blockingClock 的 Sleep 会一直阻塞，直到 release 被关闭。
+type blockingClock struct {
+	now      time.Time
+	sleeping chan struct{}
+	release  chan struct{}
+}
+
+func (c *blockingClock) Now() time.Time { return c.now }
+
+func (c *blockingClock) Sleep(d time.Duration) {
+	c.sleeping <- struct{}{}
+	<-c.release
+}
+
+func (rateLimitSuite) TestWaiters(c *gc.C) {
+	clock := &blockingClock{
+		sleeping: make(chan struct{}),
+		release:  make(chan struct{}),
+	}
+	tb := NewBucketWithClock(time.Second, 1, clock)
+	tb.Wait(1)
+	c.Assert(tb.Waiters(), gc.Equals, 0)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			tb.Wait(1)
+		}()
+		<-clock.sleeping
+	}
+	c.Assert(tb.Waiters(), gc.Equals, 3)
+	c.Assert(tb.Available(), gc.Equals, int64(-3))
+
+	close(clock.release)
+	wg.Wait()
+	c.Assert(tb.Waiters(), gc.Equals, 0)
+}
+
 func checkRate(c *gc.C, rate float64) {
 	tb := NewBucketWithRate(rate, 1<<62)
 	if !isCloseTo(tb.Rate(), rate, rateMargin) {
@@ -394,3 +2232,44 @@ func BenchmarkNewBucket(b *testing.B) {
 		NewBucketWithRate(4e18, 1<<62)
 	}
 }
+
+func BenchmarkTakeAvailableParallel(b *testing.B) {
+	tb := NewBucketWithRate(1e9, 1e9)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			tb.TakeAvailable(1)
+		}
+	})
+}
+
+func BenchmarkShardedTakeAvailableParallel(b *testing.B) {
+	sb := NewShardedBucket(16, 1e9, 1e9)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			sb.TakeAvailable(1)
+		}
+	})
+}
+
+// BenchmarkTakeAvailableWaitersParallel 在多个 goroutine 取令牌的同时读取 Waiters，
+// 用于比较锁和原子读写的 waiters 在多核下的开销 (用 -cpu 1,4,16 运行)。
+func BenchmarkTakeAvailableWaitersParallel(b *testing.B) {
+	tb := NewBucketWithRate(1e9, 1e9)
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			tb.TakeAvailable(1)
+			tb.Waiters()
+		}
+	})
+}
+
+// BenchmarkIndependentBucketsParallel 中每个 goroutine 使用自己的桶，
+// 桶之间没有共享的状态，作为 BenchmarkTakeAvailableParallel 中锁竞争的对照。
+func BenchmarkIndependentBucketsParallel(b *testing.B) {
+	b.RunParallel(func(pb *testing.PB) {
+		tb := NewBucketWithRate(1e9, 1e9)
+		for pb.Next() {
+			tb.TakeAvailable(1)
+		}
+	})
+}
@@ -0,0 +1,91 @@
+package tokenBucket
+
+import "time"
+
+// WithBackgroundRefill 返回一个 Option，
+// 令桶不再在取令牌时按经过的时间惰性地计算令牌数，
+// 而是启动一个后台 goroutine，在每个 fillInterval 的边界准时放入 quantum 个令牌。
+// 惰性计算在间隔边界附近可能短暂地多放行一些请求，后台填充使可用令牌严格跟随时间，
+// 代价是每个桶多一个 goroutine 和每个间隔一次加锁。
+// 使用这个 Option 的桶不再需要时必须调用 Close，否则 goroutine 会一直运行。
+func WithBackgroundRefill() Option {
+	return func(tb *Bucket) {
+		tb.backgroundRefill = true
+	}
+}
+
+// Close 停止后台填充的 goroutine，没有使用 WithBackgroundRefill 的桶调用它什么也不做。
+// Close 可以被调用多次。goroutine 立即停止等待并退出，之后不再放入令牌。
+func (tb *Bucket) Close() error {
+	tb.closeOnce.Do(func() {
+		close(tb.closed)
+	})
+	return nil
+}
+
+// startRefill 在设置了 WithBackgroundRefill 时启动后台填充的 goroutine。
+func (tb *Bucket) startRefill() {
+	if tb.backgroundRefill {
+		go tb.refill()
+	}
+}
+
+// refill 在每个间隔的边界放入 quantum 个令牌，直到桶被 Close。
+// 边界按 startTime 计算而不是每次睡眠 fillInterval，所以睡眠的误差不会累积。
+// 每次醒来都重新计算下一个边界，所以睡眠期间 SetRate 修改了填充间隔也没有关系。
+func (tb *Bucket) refill() {
+	for {
+		tb.mu.Lock()
+		clock := tb.clock
+		d := tb.nextRefill().Sub(clock.Now())
+		tb.mu.Unlock()
+		if d > 0 && !tb.sleepClosed(clock, d) {
+			return
+		}
+
+		select {
+		case <-tb.closed:
+			return
+		default:
+		}
+
+		tb.mu.Lock()
+		if !tb.clock.Now().Before(tb.nextRefill()) {
+			tb.availableTokens = tb.addTokens(tb.availableTokens, tb.quantum)
+			tb.latestTick++
+		}
+		tb.mu.Unlock()
+	}
+}
+
+// sleepClosed 在 clock 上睡眠 d，桶被 Close 时提前返回 false，供后台的 goroutine 使用。
+// 使用系统时钟时用可以停止的定时器等待；伪造的时钟只提供 Sleep，只能在另一个 goroutine 中调用，
+// Close 之后那个 goroutine 仍会睡到 d 结束，但调用者立即返回。
+func (tb *Bucket) sleepClosed(clock Clock, d time.Duration) bool {
+	if _, ok := clock.(realClock); ok {
+		t := time.NewTimer(d)
+		defer t.Stop()
+		select {
+		case <-t.C:
+			return true
+		case <-tb.closed:
+			return false
+		}
+	}
+	done := make(chan struct{})
+	go func() {
+		clock.Sleep(d)
+		close(done)
+	}()
+	select {
+	case <-done:
+		return true
+	case <-tb.closed:
+		return false
+	}
+}
+
+// nextRefill 返回下一次后台填充的时刻，调用者需要持有 tb.mu。
+func (tb *Bucket) nextRefill() time.Time {
+	return tb.startTime.Add(time.Duration(tb.latestTick+1) * tb.fillInterval)
+}
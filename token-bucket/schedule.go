@@ -0,0 +1,101 @@
+package tokenBucket
+
+import (
+	"sort"
+	"time"
+)
+
+// RateChange 是 ScheduledBucket 的日程中的一项：每天从 TimeOfDay (距当天零点的时间) 开始，
+// 桶的填充率为 Rate 令牌/秒，直到下一项开始。
+type RateChange struct {
+	TimeOfDay time.Duration
+	Rate      float64
+}
+
+// ScheduledBucket 是填充率按每天的日程变化的令牌桶，例如工作时间使用更高的速率。
+// 它嵌入了 *Bucket，可以像普通的桶一样使用；
+// 另外有一个后台 goroutine 在时钟越过日程中的时刻时调用 SetRate 切换速率。
+// 日程按时钟返回的时间所在的时区计算。不再需要时必须调用 Close (即嵌入的桶的 Close)，
+// goroutine 立即停止等待并退出，不会等到日程中的下一个时刻。
+type ScheduledBucket struct {
+	*Bucket
+	schedule []RateChange
+	// rate 是当前生效的日程项的速率，由嵌入的桶的 mu 保护。
+	rate float64
+}
+
+// NewScheduledBucket 返回一个按 schedule 调整 tb 填充率的 ScheduledBucket，
+// 并立即把速率设置为日程中当前时刻生效的那一项。
+// schedule 不能为空，每一项的 TimeOfDay 要在 [0, 24h) 内并且严格递增，Rate 要为正，否则 panic。
+// 每天第一项开始之前，沿用前一天最后一项的速率。
+func NewScheduledBucket(tb *Bucket, schedule []RateChange) *ScheduledBucket {
+	if len(schedule) == 0 {
+		panic("token bucket schedule is empty")
+	}
+	for i, c := range schedule {
+		if c.TimeOfDay < 0 || c.TimeOfDay >= 24*time.Hour {
+			panic("token bucket schedule time of day is not in [0, 24h)")
+		}
+		if i > 0 && c.TimeOfDay <= schedule[i-1].TimeOfDay {
+			panic("token bucket schedule is not sorted by time of day")
+		}
+		if !(c.Rate > 0) {
+			panic("token bucket schedule rate is not > 0")
+		}
+	}
+	sb := &ScheduledBucket{
+		Bucket:   tb,
+		schedule: append([]RateChange(nil), schedule...),
+	}
+	rate, _ := sb.at(sb.now())
+	sb.rate = rate
+	tb.SetRate(rate)
+	go sb.run()
+	return sb
+}
+
+// run 睡眠到日程中的下一个时刻，然后切换速率，直到 Close。
+func (sb *ScheduledBucket) run() {
+	for {
+		clock := sb.currentClock()
+		now := clock.Now()
+		_, next := sb.at(now)
+		if d := next.Sub(now); d > 0 && !sb.sleepClosed(clock, d) {
+			return
+		}
+		select {
+		case <-sb.closed:
+			return
+		default:
+		}
+
+		rate, _ := sb.at(sb.now())
+		sb.mu.Lock()
+		changed := rate != sb.rate
+		sb.rate = rate
+		sb.mu.Unlock()
+		if changed {
+			sb.SetRate(rate)
+		}
+	}
+}
+
+// at 返回 now 时刻生效的速率和下一次切换速率的时刻。
+func (sb *ScheduledBucket) at(now time.Time) (float64, time.Time) {
+	y, m, d := now.Date()
+	midnight := time.Date(y, m, d, 0, 0, 0, 0, now.Location())
+	offset := now.Sub(midnight)
+
+	// i 是当天第一个还没有开始的项
+	i := sort.Search(len(sb.schedule), func(i int) bool {
+		return sb.schedule[i].TimeOfDay > offset
+	})
+	current := sb.schedule[len(sb.schedule)-1]
+	if i > 0 {
+		current = sb.schedule[i-1]
+	}
+	if i < len(sb.schedule) {
+		return current.Rate, midnight.Add(sb.schedule[i].TimeOfDay)
+	}
+	return current.Rate, time.Date(y, m, d+1, 0, 0, 0, 0, now.Location()).Add(sb.schedule[0].TimeOfDay)
+}
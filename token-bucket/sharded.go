@@ -0,0 +1,102 @@
+package tokenBucket
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// ShardedBucket 把总的速率和容量平均分给多个内部的令牌桶 (分片)，
+// 每次取令牌时轮流选择一个分片，从而把并发的调用者分散到多把锁上，适合单个桶的锁成为瓶颈的极高吞吐量场景。
+// 选中的分片令牌不足时会依次尝试其他分片，所有分片都不足时才在选中的分片上等待。
+// 代价是不再有精确的全局公平：同一时刻一个分片上的请求可能在等待，而另一个分片上的请求立即成功。
+type ShardedBucket struct {
+	// next 是轮流选择分片的计数器，原子读写。
+	// 放在第一个字段以保证 64 位对齐，否则在 386、arm 等 32 位平台上原子操作会 panic。
+	next   uint64
+	shards []*Bucket
+}
+
+// NewShardedBucket 创建一个有 shards 个分片、总填充率为 totalRate 令牌/秒、总容量为 totalCapacity 的 ShardedBucket。
+// 每个分片的速率为 totalRate/shards，容量为 totalCapacity/shards (余数分给前面的分片)，
+// opts 应用于每个分片。shards 不为正、或 totalCapacity 小于 shards 时 panic。
+func NewShardedBucket(shards int, totalRate float64, totalCapacity int64, opts ...Option) *ShardedBucket {
+	if shards <= 0 {
+		panic("token bucket shards is not > 0")
+	}
+	if totalCapacity < int64(shards) {
+		panic("token bucket capacity is less than the number of shards")
+	}
+	sb := &ShardedBucket{shards: make([]*Bucket, shards)}
+	for i := range sb.shards {
+		capacity := totalCapacity / int64(shards)
+		if int64(i) < totalCapacity%int64(shards) {
+			capacity++
+		}
+		sb.shards[i] = NewBucketWithRate(totalRate/float64(shards), capacity, opts...)
+	}
+	return sb
+}
+
+// pick 轮流返回下一个分片的下标。
+func (sb *ShardedBucket) pick() int {
+	return int((atomic.AddUint64(&sb.next, 1) - 1) % uint64(len(sb.shards)))
+}
+
+// Take 从选中的分片取走 count 个令牌，不阻塞，返回调用者需要等待的时间。
+// 选中的分片令牌不足时依次尝试其他分片，都不足时在选中的分片上预订。
+func (sb *ShardedBucket) Take(count int64) time.Duration {
+	d, _ := sb.take(count)
+	return d
+}
+
+// take 是 Take 的内部版本，额外返回取走令牌的分片。
+func (sb *ShardedBucket) take(count int64) (time.Duration, *Bucket) {
+	i := sb.pick()
+	for j := range sb.shards {
+		tb := sb.shards[(i+j)%len(sb.shards)]
+		if _, ok := tb.TakeMaxDuration(count, 0); ok {
+			return 0, tb
+		}
+	}
+	return sb.shards[i].Take(count), sb.shards[i]
+}
+
+// Wait 取走 count 个令牌，等待直到令牌可用。
+// 等待在预订令牌的分片上进行，计入它的 Waiters，分片被 Shutdown 时提前返回并归还令牌。
+func (sb *ShardedBucket) Wait(count int64) {
+	if d, tb := sb.take(count); d > 0 {
+		if err := tb.sleep(d); err != nil {
+			tb.Return(count)
+		}
+	}
+}
+
+// TakeAvailable 不阻塞地从各个分片取走最多 count 个立即可用的令牌，返回取走的数量。
+func (sb *ShardedBucket) TakeAvailable(count int64) int64 {
+	i := sb.pick()
+	var n int64
+	for j := range sb.shards {
+		if n >= count {
+			break
+		}
+		n += sb.shards[(i+j)%len(sb.shards)].TakeAvailable(count - n)
+	}
+	return n
+}
+
+// Available 返回所有分片可用令牌数的和，各个分片分别加锁读取，结果不是一个一致的快照。
+func (sb *ShardedBucket) Available() int64 {
+	var n int64
+	for _, tb := range sb.shards {
+		n += tb.Available()
+	}
+	return n
+}
+
+// Close 关闭所有分片，见 Bucket.Close。
+func (sb *ShardedBucket) Close() error {
+	for _, tb := range sb.shards {
+		tb.Close()
+	}
+	return nil
+}
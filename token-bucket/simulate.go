@@ -0,0 +1,62 @@
+package tokenBucket
+
+import "time"
+
+// Decision 是模拟中一个请求的结果，见 Simulate。
+type Decision struct {
+	// Admitted 报告请求是否取到了令牌。
+	Admitted bool
+	// AdmittedAt 是请求实际可以执行的时刻，即到达的时刻加上 Wait；没有取到令牌时为零值。
+	AdmittedAt time.Time
+	// Wait 是请求为了等待令牌需要延迟的时间。
+	Wait time.Duration
+}
+
+// Simulate 用与 tb 相同的配置离线回放一组请求，返回每个请求的结果，用于容量规划。
+// trace 是请求到达的时刻，每个请求取走 count 个令牌，并且都会被放行，只是可能需要等待。
+// 模拟在内部用模拟时钟创建一个新的桶，从 tb 现在的令牌数 (包括欠下的令牌) 开始，
+// 例如 NewUnboundedBurstBucket 和 WithStartEmpty 创建的桶从空的状态开始；
+// 时钟从 trace[0] 开始，依次推进到每个请求到达的时刻，所以结果是确定的，也不会修改 tb。
+// trace 应当按时间递增，早于前一个请求的时刻按前一个请求的时刻处理。
+func (tb *Bucket) Simulate(trace []time.Time, count int64) []Decision {
+	return tb.SimulateMaxDuration(trace, count, infinityDuration)
+}
+
+// SimulateMaxDuration 与 Simulate 相同，但每个请求像 TakeMaxDuration 一样最多等待 maxWait，
+// 需要等待更久的请求被拒绝，不取走令牌。
+func (tb *Bucket) SimulateMaxDuration(trace []time.Time, count int64, maxWait time.Duration) []Decision {
+	decisions := make([]Decision, len(trace))
+	if len(trace) == 0 {
+		return decisions
+	}
+
+	clock := &simClock{now: trace[0]}
+	tb.mu.Lock()
+	sim := newBucket(tb.fillInterval, tb.capacity, WithQuantum(tb.quantum), WithClock(clock))
+	sim.exactWait = tb.exactWait
+	sim.alignedFill = tb.alignedFill
+	// 在 newBucket 之后设置，它不接受负的初始令牌数
+	sim.availableTokens = tb.tokensAt(tb.clock.Now())
+	tb.mu.Unlock()
+	sim.init()
+
+	for i, at := range trace {
+		if at.After(clock.now) {
+			clock.now = at
+		}
+		d, ok := sim.take(clock.now, count, maxWait)
+		if ok {
+			decisions[i] = Decision{Admitted: true, AdmittedAt: clock.now.Add(d), Wait: d}
+		}
+	}
+	return decisions
+}
+
+// simClock 是 Simulate 使用的模拟时钟，只由 Simulate 推进。
+type simClock struct {
+	now time.Time
+}
+
+func (c *simClock) Now() time.Time { return c.now }
+
+func (c *simClock) Sleep(d time.Duration) { c.now = c.now.Add(d) }
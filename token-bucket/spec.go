@@ -0,0 +1,78 @@
+package tokenBucket
+
+import (
+	"errors"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// specUnits 是 NewFromString 支持的时间单位。
+var specUnits = map[string]time.Duration{
+	"s": time.Second,
+	"m": time.Minute,
+	"h": time.Hour,
+}
+
+// maxSpecRate 是 NewFromString 接受的最大速率，再大的速率 quantumForRate 找不到合适的 quantum。
+const maxSpecRate = 1e18
+
+// NewFromString 按配置中的速率描述创建令牌桶，例如 "20/s burst=40" 表示每秒 20 个令牌、容量 40。
+// 描述由 "<数量>/<单位>" 和可选的 "burst=<容量>" 组成，以空格分隔；
+// 数量是正数 (可以是小数)，单位为 s、m 或 h；没有 burst 时容量为数量向上取整。
+// 桶由 NewBucketWithRate 创建，opts 原样传给它。描述无效时返回错误。
+func NewFromString(spec string, opts ...Option) (*Bucket, error) {
+	rate, capacity, err := parseSpec(spec)
+	if err != nil {
+		return nil, err
+	}
+	return NewBucketWithRate(rate, capacity, opts...), nil
+}
+
+// parseSpec 解析 NewFromString 的速率描述，返回每秒的速率和容量。
+func parseSpec(spec string) (float64, int64, error) {
+	bad := func(reason string) (float64, int64, error) {
+		return 0, 0, errors.New("token bucket spec " + strconv.Quote(spec) + ": " + reason)
+	}
+	fields := strings.Fields(spec)
+	if len(fields) == 0 || len(fields) > 2 {
+		return bad(`want "<count>/<unit>" with an optional "burst=<n>"`)
+	}
+
+	i := strings.IndexByte(fields[0], '/')
+	if i < 0 {
+		return bad("missing /<unit>")
+	}
+	count, err := strconv.ParseFloat(fields[0][:i], 64)
+	if err != nil || !(count > 0) || math.IsInf(count, 1) {
+		return bad("count is not a positive number")
+	}
+	unit, ok := specUnits[fields[0][i+1:]]
+	if !ok {
+		return bad("unit is not s, m or h")
+	}
+	rate := count / unit.Seconds()
+	if rate < minMustRate {
+		return bad("rate is too small")
+	}
+	if rate > maxSpecRate {
+		return bad("rate is too large")
+	}
+
+	capacity := int64(math.MaxInt64)
+	if count < math.MaxInt64 {
+		capacity = int64(math.Ceil(count))
+	}
+	if len(fields) == 2 {
+		burst := strings.TrimPrefix(fields[1], "burst=")
+		if burst == fields[1] {
+			return bad("unknown option " + strconv.Quote(fields[1]))
+		}
+		capacity, err = strconv.ParseInt(burst, 10, 64)
+		if err != nil || capacity <= 0 {
+			return bad("burst is not a positive integer")
+		}
+	}
+	return rate, capacity, nil
+}